@@ -8,12 +8,24 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type Sonnenbatterie struct {
-	baseURL url.URL
+	rootURL url.URL
 	token   string
 	Client  *http.Client
+
+	// SchemaCheck enables strict mode when set. It is called with the
+	// unknown and missing fields of every decoded document.
+	SchemaCheck func(SchemaReport)
+
+	mu      sync.Mutex
+	version Version
+	// probing is the running version detection, nil if none runs
+	probing *versionProbe
 }
 
 func NewSonnenbatterie(urlString, token string) (*Sonnenbatterie, error) {
@@ -21,11 +33,11 @@ func NewSonnenbatterie(urlString, token string) (*Sonnenbatterie, error) {
 	if err != nil {
 		return nil, err
 	}
-	u.Path = filepath.Join(u.Path, "api/v2/")
 	return &Sonnenbatterie{
-		baseURL: *u,
+		rootURL: *u,
 		Client:  http.DefaultClient,
 		token:   token,
+		version: V2,
 	}, nil
 }
 
@@ -47,12 +59,50 @@ func (f *Sonnenbatterie) newRequest(ctx context.Context, method, url string, bod
 
 }
 
+func (f *Sonnenbatterie) endpointURL(version Version, endpoint string) string {
+	u := f.rootURL
+	u.Path = filepath.Join(u.Path, "api", version.String(), endpoint)
+	return u.String()
+}
+
+// get fetches the endpoint below the API root and decodes it into v. In
+// strict mode the document is also checked against the fields of v.
+func (f *Sonnenbatterie) get(ctx context.Context, version Version, endpoint, what string, v any) error {
+	req, err := f.newRequest(ctx, "GET", f.endpointURL(version, endpoint), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", what, err)
+	}
+
+	if f.SchemaCheck != nil {
+		f.SchemaCheck(checkSchema(endpoint, body, v))
+	}
+	return nil
+}
+
 // see https://jlunz.github.io/homeassistant/#/api/getApiV2Status
 type Status struct {
 	// All AC output of apparent power in VA
 	ApparentOutput int `json:"Apparent_output"`
 	// 	Backup-buffer in percentage that is set on the system.
-	BackupBuffer string `json:"BackupBuffer"`
+	BackupBuffer FlexString `json:"BackupBuffer"`
 	// Boolean that indicates the charge status. True if charging
 	BatteryCharging bool `json:"BatteryCharging"`
 	// Boolean that indicates the discharge status. True if discharging
@@ -82,13 +132,13 @@ type Status struct {
 	// Operating mode that is set on the system:
 	// * 1: Manual charging or discharging via API
 	// * 2: Automatic Self Consumption. Default
-	OperatingMode string `json:"OperatingMode"`
+	OperatingMode FlexString `json:"OperatingMode"`
 	// AC Power greater than ZERO is discharging Inverter AC Power less than ZERO is charging
 	PacTotalW int `json:"Pac_total_W"`
 	// PV production in watts
 	ProductionW int `json:"Production_W"`
 	// Relative state of charge
-	Rsoc int `json:"RSOC"`
+	Rsoc FlexFloat `json:"RSOC"`
 	// Remaining capacity based on RSOC
 	RemainingCapacityWh int `json:"RemainingCapacity_Wh"`
 	// Output of apparent power in VA on Phase 1-3
@@ -100,7 +150,7 @@ type Status struct {
 	// Local system time
 	Timestamp string `json:"Timestamp"`
 	// User state of charge
-	Usoc int `json:"USOC"`
+	Usoc FlexFloat `json:"USOC"`
 	// AC voltage in volts
 	Uac float64 `json:"Uac"`
 	// Battery voltage in volts
@@ -111,27 +161,27 @@ type Status struct {
 	GeneratorAutostart bool `json:"generator_autostart"`
 }
 
-func (f *Sonnenbatterie) GetStatus(ctx context.Context) (*Status, error) {
-	u := f.baseURL
-	u.Path = filepath.Join(u.Path, "status")
-	req, err := f.newRequest(ctx, "GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+// TimestampLayout is the format of the local system time reported by the
+// battery.
+const TimestampLayout = "2006-01-02 15:04:05"
 
-	resp, err := f.Client.Do(req)
+// Time parses Timestamp as wall clock time in the battery's time zone loc.
+func (s *Status) Time(loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation(TimestampLayout, s.Timestamp, loc)
+}
+
+func (f *Sonnenbatterie) GetStatus(ctx context.Context) (*Status, error) {
+	version, err := f.resolveVersion(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected http status: %s", resp.Status)
+	if version == V1 {
+		return f.getStatusV1(ctx)
 	}
-	defer resp.Body.Close()
 
 	var status Status
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-		return nil, fmt.Errorf("error parsing status: %w", err)
+	if err := f.get(ctx, V2, "status", "status", &status); err != nil {
+		return nil, err
 	}
 	return &status, nil
 }
@@ -164,26 +214,12 @@ type PowerMeter struct {
 
 // Gets the latest power-meter measurements (Read API)
 func (f *Sonnenbatterie) GetPowerMeter(ctx context.Context) (production *PowerMeter, consumption *PowerMeter, err error) {
-	u := f.baseURL
-	u.Path = filepath.Join(u.Path, "powermeter")
-	req, err := f.newRequest(ctx, "GET", u.String(), nil)
-	if err != nil {
+	if err := f.requireV2(ctx); err != nil {
 		return nil, nil, err
 	}
-
-	resp, err := f.Client.Do(req)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, nil, fmt.Errorf("unexpected http status: %s", resp.Status)
-	}
-	defer resp.Body.Close()
-
 	var status []PowerMeter
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-		return nil, nil, fmt.Errorf("error parsing powermeters: %w", err)
+	if err := f.get(ctx, V2, "powermeter", "powermeters", &status); err != nil {
+		return nil, nil, err
 	}
 
 	for i := range status {
@@ -213,28 +249,13 @@ type LatestData struct {
 
 // Gets latest data for this sonnenBatterie (Read API)
 func (f *Sonnenbatterie) GetLatestData(ctx context.Context) (*LatestData, error) {
-	u := f.baseURL
-	u.Path = filepath.Join(u.Path, "latestdata")
-	req, err := f.newRequest(ctx, "GET", u.String(), nil)
-	if err != nil {
+	if err := f.requireV2(ctx); err != nil {
 		return nil, err
 	}
-
-	resp, err := f.Client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected http status: %s", resp.Status)
-	}
-	defer resp.Body.Close()
-
 	var status LatestData
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-		return nil, fmt.Errorf("error parsing powermeters: %w", err)
+	if err := f.get(ctx, V2, "latestdata", "latest data", &status); err != nil {
+		return nil, err
 	}
-
 	return &status, nil
 }
 
@@ -257,31 +278,130 @@ type BatteryModuleData struct {
 	SystemDCVoltage        float64 `json:"systemdcvoltage"`
 	SystemStatus           float64 `json:"systemstatus"`
 	SystemWarning          float64 `json:"systemwarning"`
+	// Per module values of multi-module stacks, only sent by some firmware
+	Modules []BatteryModule `json:"modules,omitempty"`
+}
+
+type BatteryModule struct {
+	// Module identifier, empty if the firmware only reports the position
+	ID                     FlexString `json:"id,omitempty"`
+	CycleCount             float64    `json:"cyclecount"`
+	FullChargeCapacity     float64    `json:"fullchargecapacity"`
+	MaximumCellTemperature float64    `json:"maximumcelltemperature"`
+	MaximumCellVoltage     float64    `json:"maximumcellvoltage"`
+	MinimumCellTemperature float64    `json:"minimumcelltemperature"`
+	MinimumCellVoltage     float64    `json:"minimumcellvoltage"`
+	ModuleCurrent          float64    `json:"modulecurrent"`
+	ModuleDCVoltage        float64    `json:"moduledcvoltage"`
+	RelativeStateOfCharge  float64    `json:"relativestateofcharge"`
+	RemainingCapacity      float64    `json:"remainingcapacity"`
+}
+
+// ModuleName returns the module's identifier, or its one based position in the
+// stack if the firmware does not send one.
+func (d *BatteryModuleData) ModuleName(i int) string {
+	if id := d.Modules[i].ID; id != "" {
+		return string(id)
+	}
+	return strconv.Itoa(i + 1)
 }
 
 // Gets battery module data for this sonnenBatterie (Read API)
 func (f *Sonnenbatterie) GetBatteryModuleData(ctx context.Context) (*BatteryModuleData, error) {
-	u := f.baseURL
-	u.Path = filepath.Join(u.Path, "battery")
-	req, err := f.newRequest(ctx, "GET", u.String(), nil)
-	if err != nil {
+	if err := f.requireV2(ctx); err != nil {
 		return nil, err
 	}
-
-	resp, err := f.Client.Do(req)
-	if err != nil {
+	var battery_module BatteryModuleData
+	if err := f.get(ctx, V2, "battery", "battery module", &battery_module); err != nil {
 		return nil, err
 	}
+	return &battery_module, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected http status: %s", resp.Status)
+type Inverter struct {
+	// AC frequency in hertz
+	Fac float64 `json:"fac"`
+	// AC current in amperes over all phases
+	IacTotal float64 `json:"iac_total"`
+	// Battery current in amperes
+	Ibat float64 `json:"ibat"`
+	// PV current in amperes
+	Ipv float64 `json:"ipv"`
+	// AC power of the microgrid in watts
+	PacMicrogrid float64 `json:"pac_microgrid"`
+	// AC power in watts, greater zero is discharging
+	PacTotal float64 `json:"pac_total"`
+	// Battery power in watts
+	Pbat float64 `json:"pbat"`
+	// Phase angle
+	Phi float64 `json:"phi"`
+	// PV power in watts
+	Ppv float64 `json:"ppv"`
+	// Apparent AC power in VA over all phases
+	SacTotal float64 `json:"sac_total"`
+	// Maximum inverter temperature in degrees celsius, the inverter derates
+	// its power when it runs hot
+	Tmax float64 `json:"tmax"`
+	// AC voltage in volts
+	Uac float64 `json:"uac"`
+	// Battery voltage in volts
+	Ubat float64 `json:"ubat"`
+	// DC link voltage in volts
+	Udc float64 `json:"udc"`
+	// PV voltage in volts
+	Upv float64 `json:"upv"`
+}
+
+// Gets inverter measurements for this sonnenBatterie (Read API)
+func (f *Sonnenbatterie) GetInverter(ctx context.Context) (*Inverter, error) {
+	if err := f.requireV2(ctx); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
+	var inverter Inverter
+	if err := f.get(ctx, V2, "inverter", "inverter", &inverter); err != nil {
+		return nil, err
+	}
+	return &inverter, nil
+}
 
-	var battery_module BatteryModuleData
-	if err := json.NewDecoder(resp.Body).Decode(&battery_module); err != nil {
-		return nil, fmt.Errorf("error parsing battery module: %w", err)
+// IO holds the digital inputs, outputs and relays by channel name. Channels
+// are reported as 1 if set and 0 otherwise, entries that are neither
+// booleans nor numbers are skipped.
+type IO struct {
+	Channels map[string]float64
+}
+
+func (s *IO) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	s.Channels = make(map[string]float64, len(raw))
+	for name, value := range raw {
+		var set bool
+		if err := json.Unmarshal(value, &set); err == nil {
+			s.Channels[name] = 0
+			if set {
+				s.Channels[name] = 1
+			}
+			continue
+		}
+		var n FlexFloat
+		if err := json.Unmarshal(value, &n); err == nil {
+			s.Channels[name] = float64(n)
+		}
 	}
+	return nil
+}
 
-	return &battery_module, nil
+// Gets the digital I/O and relay states for this sonnenBatterie (Read API)
+func (f *Sonnenbatterie) GetIO(ctx context.Context) (*IO, error) {
+	if err := f.requireV2(ctx); err != nil {
+		return nil, err
+	}
+	var state IO
+	if err := f.get(ctx, V2, "io", "io", &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
 }
@@ -0,0 +1,330 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/api/apitest"
+	"github.com/joconcepts/sonnenbatterie-exporter/simulator"
+)
+
+func newClient(t *testing.T, token string) (*api.Sonnenbatterie, *apitest.Server) {
+	t.Helper()
+	srv := apitest.NewServer()
+	t.Cleanup(srv.Close)
+	a, err := api.NewSonnenbatterie(srv.URL, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, srv
+}
+
+func TestGetStatus(t *testing.T) {
+	a, _ := newClient(t, "")
+
+	status, err := a.GetStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Rsoc != 7 || status.Usoc != 0 {
+		t.Errorf("unexpected state of charge: rsoc=%v usoc=%v", status.Rsoc, status.Usoc)
+	}
+	if status.SystemStatus != "OnGrid" {
+		t.Errorf("unexpected system status %q", status.SystemStatus)
+	}
+	if status.Fac != 50.013 {
+		t.Errorf("unexpected frequency %v", status.Fac)
+	}
+}
+
+func TestGetPowerMeter(t *testing.T) {
+	a, _ := newClient(t, "secret")
+
+	production, consumption, err := a.GetPowerMeter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if production.Direction != "production" || production.KwhImported != 12.38984375 {
+		t.Errorf("unexpected production meter %+v", production)
+	}
+	if consumption.Direction != "consumption" || consumption.WL1 != 427.5 {
+		t.Errorf("unexpected consumption meter %+v", consumption)
+	}
+}
+
+func TestGetPowerMeterMissingDirection(t *testing.T) {
+	a, srv := newClient(t, "")
+	srv.SetRawPayload(apitest.EndpointPowerMeter, []byte(`[{"direction":"consumption"}]`))
+
+	_, _, err := a.GetPowerMeter(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no production powermeter") {
+		t.Fatalf("expected missing production meter error, got %v", err)
+	}
+}
+
+func TestGetLatestData(t *testing.T) {
+	a, _ := newClient(t, "")
+
+	latest, err := a.GetLatestData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.FullChargeCapacity != 15000 || latest.IcStatus.SecondsSinceFullCharge != 3600 {
+		t.Errorf("unexpected latest data %+v", latest)
+	}
+}
+
+func TestGetBatteryModuleData(t *testing.T) {
+	a, _ := newClient(t, "")
+
+	battery, err := a.GetBatteryModuleData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if battery.CycleCount != 412 || battery.MaximumCellVoltage != 3.257 {
+		t.Errorf("unexpected battery module data %+v", battery)
+	}
+}
+
+func TestToken(t *testing.T) {
+	a, srv := newClient(t, "wrong")
+	srv.SetToken("secret")
+
+	if _, err := a.GetStatus(context.Background()); err != nil {
+		t.Errorf("status should not require a token: %v", err)
+	}
+	_, err := a.GetLatestData(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+
+	good, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := good.GetLatestData(context.Background()); err != nil {
+		t.Errorf("unexpected error with valid token: %v", err)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	a, srv := newClient(t, "")
+	srv.SetError(apitest.EndpointBattery, http.StatusInternalServerError)
+
+	_, err := a.GetBatteryModuleData(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unexpected http status") {
+		t.Fatalf("expected http status error, got %v", err)
+	}
+}
+
+func TestMalformedJSON(t *testing.T) {
+	a, srv := newClient(t, "")
+	srv.SetMalformed(apitest.EndpointStatus, true)
+
+	_, err := a.GetStatus(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "error parsing status") {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	a, srv := newClient(t, "")
+	srv.SetLatency(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.GetStatus(ctx); err == nil {
+		t.Fatal("expected timeout error")
+	}
+}
+
+func TestSchemaCheck(t *testing.T) {
+	a, srv := newClient(t, "")
+	var reports []api.SchemaReport
+	a.SchemaCheck = func(r api.SchemaReport) { reports = append(reports, r) }
+
+	if _, err := a.GetStatus(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetRawPayload(apitest.EndpointStatus, []byte(`{"RSOC_percent": 7, "USOC": 0}`))
+	if _, err := a.GetStatus(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetLatestData(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 reports, got %d", len(reports))
+	}
+	if r := reports[0]; len(r.Unknown) != 0 || len(r.Missing) != 0 {
+		t.Errorf("expected default status to match, got %+v", r)
+	}
+	if r := reports[1]; len(r.Unknown) != 1 || r.Unknown[0] != "RSOC_percent" || !slices.Contains(r.Missing, "RSOC") || slices.Contains(r.Missing, "USOC") {
+		t.Errorf("unexpected drifted status report %+v", r)
+	}
+	if r := reports[2]; r.Endpoint != "latestdata" || !slices.Contains(r.Unknown, "ic_status.statebms") || len(r.Missing) != 0 {
+		t.Errorf("unexpected latest data report %+v", r)
+	}
+}
+
+func TestFlexibleStatusFields(t *testing.T) {
+	a, srv := newClient(t, "")
+	srv.SetRawPayload(apitest.EndpointStatus, []byte(`{
+		"BackupBuffer": 10,
+		"OperatingMode": 2,
+		"RSOC": "7.5",
+		"USOC": 3.2,
+		"Pac_total_W": 617
+	}`))
+
+	status, err := a.GetStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.BackupBuffer != "10" || status.OperatingMode != "2" {
+		t.Errorf("unexpected string fields: backup buffer %q, operating mode %q", status.BackupBuffer, status.OperatingMode)
+	}
+	if status.Rsoc != 7.5 || status.Usoc != 3.2 {
+		t.Errorf("unexpected state of charge: rsoc=%v usoc=%v", status.Rsoc, status.Usoc)
+	}
+	if status.PacTotalW != 617 {
+		t.Errorf("unexpected pac total %d", status.PacTotalW)
+	}
+}
+
+func TestVersionDetection(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		server  func() *apitest.Server
+		version api.Version
+		rsoc    api.FlexFloat
+	}{
+		{"v2", apitest.NewServer, api.V2, 7},
+		{"v1", apitest.NewLegacyServer, api.V1, 42},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := tc.server()
+			defer srv.Close()
+			a, err := api.NewSonnenbatterie(srv.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.SetVersion(api.VersionAuto)
+
+			status, err := a.GetStatus(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Version() != tc.version {
+				t.Errorf("expected version %s, got %s", tc.version, a.Version())
+			}
+			if status.Rsoc != tc.rsoc || status.SystemStatus != "OnGrid" {
+				t.Errorf("unexpected status %+v", status)
+			}
+		})
+	}
+}
+
+func TestVersionDetectionConcurrent(t *testing.T) {
+	a, srv := newClient(t, "")
+	a.SetVersion(api.VersionAuto)
+	srv.SetLatency(100 * time.Millisecond)
+
+	// callers share the probe instead of queuing behind each other's probes
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.GetStatus(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// one probe and one status request per caller
+	if n := srv.Requests(apitest.EndpointStatus); n != 6 {
+		t.Errorf("expected 6 status requests, got %d", n)
+	}
+
+	// a caller whose context ends does not wait for the probe
+	a.SetVersion(api.VersionAuto)
+	srv.SetLatency(time.Second)
+	go func() { _, _ = a.GetStatus(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := a.GetStatus(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to end the wait, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("waited %s for the probe of another caller", d)
+	}
+}
+
+func TestV1Unsupported(t *testing.T) {
+	srv := apitest.NewLegacyServer()
+	defer srv.Close()
+	a, err := api.NewSonnenbatterie(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetVersion(api.V1)
+
+	if _, err := a.GetBatteryModuleData(context.Background()); !errors.Is(err, api.ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+	if srv.Requests(apitest.EndpointBattery) != 0 {
+		t.Error("unsupported endpoint should not be requested")
+	}
+}
+
+func TestWriteCalls(t *testing.T) {
+	battery := simulator.New(simulator.DefaultConfig(), time.Now)
+	srv := httptest.NewServer(battery.Handler("token"))
+	t.Cleanup(srv.Close)
+	a, err := api.NewSonnenbatterie(srv.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// setpoints are rejected outside of manual mode
+	if err := a.Charge(ctx, 2000); err == nil {
+		t.Error("expected charge in self consumption mode to fail")
+	}
+	if err := a.SetOperatingMode(ctx, api.ModeManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Charge(ctx, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetBackupBuffer(ctx, 30); err != nil {
+		t.Fatal(err)
+	}
+	status, err := a.GetStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.OperatingMode != api.ModeManual || status.PacTotalW != -2000 || status.BackupBuffer != "30" {
+		t.Errorf("unexpected status after write calls: mode %s, power %d, buffer %s", status.OperatingMode, status.PacTotalW, status.BackupBuffer)
+	}
+
+	noToken, err := api.NewSonnenbatterie(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := noToken.Discharge(ctx, 1000); !errors.Is(err, api.ErrNoToken) {
+		t.Errorf("expected ErrNoToken, got %v", err)
+	}
+}
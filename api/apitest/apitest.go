@@ -0,0 +1,173 @@
+// Package apitest provides an in-process fake sonnenBatterie serving the v2
+// or legacy v1 JSON API, for use in tests of the api client and the exporter.
+package apitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints served below /api/v2/.
+const (
+	EndpointStatus     = "status"
+	EndpointPowerMeter = "powermeter"
+	EndpointLatestData = "latestdata"
+	EndpointBattery    = "battery"
+	EndpointInverter   = "inverter"
+	EndpointIO         = "io"
+)
+
+// Endpoints served by default, in a stable order.
+var Endpoints = []string{EndpointStatus, EndpointPowerMeter, EndpointLatestData, EndpointBattery, EndpointInverter, EndpointIO}
+
+// Server is a fake sonnenBatterie. All setters are safe to call while the
+// server is handling requests.
+type Server struct {
+	*httptest.Server
+
+	legacy bool
+
+	mu        sync.Mutex
+	token     string
+	latency   time.Duration
+	payloads  map[string][]byte
+	errors    map[string]int
+	malformed map[string]bool
+	requests  map[string]int
+}
+
+// NewServer starts a fake battery serving the canned default payloads.
+// Callers must Close it.
+func NewServer() *Server {
+	return newServer(false, defaultPayloads)
+}
+
+// NewLegacyServer starts a fake battery of older firmware that only serves
+// status below /api/v1/. Callers must Close it.
+func NewLegacyServer() *Server {
+	return newServer(true, legacyPayloads)
+}
+
+func newServer(legacy bool, payloads map[string]string) *Server {
+	s := &Server{
+		legacy:    legacy,
+		payloads:  map[string][]byte{},
+		errors:    map[string]int{},
+		malformed: map[string]bool{},
+		requests:  map[string]int{},
+	}
+	for endpoint, payload := range payloads {
+		s.payloads[endpoint] = []byte(payload)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SetToken makes every endpoint except status require the given Auth-Token.
+// An empty token disables the check.
+func (s *Server) SetToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetPayload serves v encoded as JSON on the endpoint.
+func (s *Server) SetPayload(endpoint string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.SetRawPayload(endpoint, b)
+	return nil
+}
+
+// SetRawPayload serves body verbatim on the endpoint.
+func (s *Server) SetRawPayload(endpoint string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads[endpoint] = body
+}
+
+// SetError makes the endpoint answer with the given HTTP status code. A code
+// of 0 restores normal responses.
+func (s *Server) SetError(endpoint string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code == 0 {
+		delete(s.errors, endpoint)
+		return
+	}
+	s.errors[endpoint] = code
+}
+
+// SetMalformed makes the endpoint answer with a truncated JSON document.
+func (s *Server) SetMalformed(endpoint string, malformed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.malformed[endpoint] = malformed
+}
+
+// Requests returns how many requests the endpoint has received.
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/api/v2/"
+	if s.legacy {
+		prefix = "/api/v1/"
+	}
+	endpoint, ok := strings.CutPrefix(r.URL.Path, prefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests[endpoint]++
+	token := s.token
+	latency := s.latency
+	payload, found := s.payloads[endpoint]
+	code := s.errors[endpoint]
+	malformed := s.malformed[endpoint]
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch {
+	case !found:
+		http.NotFound(w, r)
+		return
+	case token != "" && endpoint != EndpointStatus && r.Header.Get("Auth-Token") != token:
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	case code != 0:
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	if malformed {
+		payload = payload[:len(payload)/2]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(payload)
+}
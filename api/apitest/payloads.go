@@ -0,0 +1,185 @@
+package apitest
+
+// Canned responses modelled on a three module sonnenBatterie talking the v2
+// API, trimmed to a representative set of fields.
+var defaultPayloads = map[string]string{
+	EndpointStatus: `{
+		"Apparent_output": 225,
+		"BackupBuffer": "10",
+		"BatteryCharging": false,
+		"BatteryDischarging": true,
+		"Consumption_Avg": 629,
+		"Consumption_W": 629,
+		"Fac": 50.013,
+		"FlowConsumptionBattery": true,
+		"FlowConsumptionGrid": false,
+		"FlowConsumptionProduction": false,
+		"FlowGridBattery": false,
+		"FlowProductionBattery": false,
+		"FlowProductionGrid": false,
+		"GridFeedIn_W": -12,
+		"IsSystemInstalled": 1,
+		"OperatingMode": "2",
+		"Pac_total_W": 617,
+		"Production_W": 0,
+		"RSOC": 7,
+		"RemainingCapacity_Wh": 717,
+		"Sac1": 225,
+		"Sac2": null,
+		"Sac3": null,
+		"SystemStatus": "OnGrid",
+		"Timestamp": "2024-12-29 13:45:05",
+		"USOC": 0,
+		"Uac": 236,
+		"Ubat": 53,
+		"dischargeNotAllowed": false,
+		"generator_autostart": false
+	}`,
+	EndpointPowerMeter: `[
+		{
+			"a_l1": 0.1, "a_l2": 0, "a_l3": 0, "a_total": 0.1,
+			"channel": 1, "deviceid": 4, "direction": "production", "error": -1,
+			"frequency": 50.013, "kwh_exported": 0, "kwh_imported": 12.38984375,
+			"v_l1_l2": 410.5, "v_l1_n": 236, "v_l2_l3": 411.3, "v_l2_n": 226, "v_l3_l1": 408, "v_l3_n": 236,
+			"va_total": 23.6, "var_total": -21.1,
+			"w_l1": -7.6, "w_l2": 0, "w_l3": 0, "w_total": -7.6
+		},
+		{
+			"a_l1": 1.9, "a_l2": 0.9, "a_l3": 0.1, "a_total": 2.9,
+			"channel": 2, "deviceid": 4, "direction": "consumption", "error": -1,
+			"frequency": 50.013, "kwh_exported": 0, "kwh_imported": 99.123,
+			"v_l1_l2": 410.5, "v_l1_n": 236, "v_l2_l3": 411.3, "v_l2_n": 226, "v_l3_l1": 408, "v_l3_n": 236,
+			"va_total": 684.4, "var_total": 101.2,
+			"w_l1": 427.5, "w_l2": 190.8, "w_l3": 21, "w_total": 639.3
+		}
+	]`,
+	EndpointLatestData: `{
+		"Consumption_W": 629,
+		"FullChargeCapacity": 15000,
+		"GridFeedIn_W": -12,
+		"Pac_total_W": 617,
+		"Production_W": 0,
+		"RSOC": 7,
+		"SetPoint_W": 0,
+		"Timestamp": "2024-12-29 13:45:05",
+		"USOC": 0,
+		"UTC_Offet": 1,
+		"ic_status": {
+			"DC Shutdown Reason": {},
+			"Eclipse Led": {"Pulsing Green": true},
+			"nrbatterymodules": 3,
+			"secondssincefullcharge": 3600,
+			"statebms": "ready",
+			"statecorecontrolmodule": "ongrid",
+			"stateinverter": "running",
+			"timestamp": "2024-12-29 13:45:05"
+		}
+	}`,
+	EndpointBattery: `{
+		"balancechargerequest": 0,
+		"chargecurrentlimit": 39.97,
+		"cyclecount": 412,
+		"dischargecurrentlimit": 39.97,
+		"fullchargecapacity": 201.98,
+		"maximumcelltemperature": 19.95,
+		"maximumcellvoltage": 3.257,
+		"maximumcellvoltagenum": 0,
+		"maximummodulecurrent": 0,
+		"maximummoduledcvoltage": 104.15,
+		"maximummoduletemperature": -273.15,
+		"minimumcelltemperature": 18.95,
+		"minimumcellvoltage": 3.251,
+		"minimumcellvoltagenum": 0,
+		"minimummodulecurrent": 0,
+		"minimummoduledcvoltage": 104.15,
+		"minimummoduletemperature": -273.15,
+		"relativestateofcharge": 7,
+		"remainingcapacity": 14.29,
+		"systemalarm": 0,
+		"systemcurrent": -5.9,
+		"systemdcvoltage": 208.3,
+		"systemstatus": 49,
+		"systemtemperature": 0,
+		"systemvoltage": 208.3,
+		"systemwarning": 0,
+		"totalvolume": 0,
+		"usableremainingcapacity": 0,
+		"modules": [
+			{
+				"cyclecount": 412, "fullchargecapacity": 67.4,
+				"maximumcelltemperature": 19.95, "minimumcelltemperature": 19.15,
+				"maximumcellvoltage": 3.257, "minimumcellvoltage": 3.254,
+				"modulecurrent": -1.97, "moduledcvoltage": 52.07,
+				"relativestateofcharge": 7, "remainingcapacity": 4.77
+			},
+			{
+				"cyclecount": 412, "fullchargecapacity": 67.5,
+				"maximumcelltemperature": 19.55, "minimumcelltemperature": 18.95,
+				"maximumcellvoltage": 3.256, "minimumcellvoltage": 3.253,
+				"modulecurrent": -1.97, "moduledcvoltage": 52.05,
+				"relativestateofcharge": 7, "remainingcapacity": 4.79
+			},
+			{
+				"cyclecount": 415, "fullchargecapacity": 61.2,
+				"maximumcelltemperature": 19.75, "minimumcelltemperature": 19.05,
+				"maximumcellvoltage": 3.255, "minimumcellvoltage": 3.251,
+				"modulecurrent": -1.96, "moduledcvoltage": 52.03,
+				"relativestateofcharge": 6, "remainingcapacity": 4.73
+			}
+		]
+	}`,
+	EndpointInverter: `{
+		"fac": 50.013,
+		"iac_total": 2.71,
+		"ibat": 11.9,
+		"ipv": 0,
+		"pac_microgrid": 0,
+		"pac_total": 617.2,
+		"pbat": 630.5,
+		"phi": -0.98,
+		"ppv": 0,
+		"sac_total": 640.1,
+		"tmax": 47.5,
+		"uac": 236.1,
+		"ubat": 53.1,
+		"udc": 402.7,
+		"upv": 0
+	}`,
+	EndpointIO: `{
+		"DI_1": false,
+		"DI_2": true,
+		"DO_1": 0,
+		"DO_2": "1",
+		"relay_self_consumption": true,
+		"firmware": "1.14.5"
+	}`,
+}
+
+// Status of a legacy battery speaking the v1 API.
+var legacyPayloads = map[string]string{
+	EndpointStatus: `{
+		"BatteryCharging": true,
+		"BatteryDischarging": false,
+		"Consumption_W": 431,
+		"Fac": 49.995,
+		"FlowConsumptionBattery": false,
+		"FlowConsumptionGrid": false,
+		"FlowConsumptionProduction": true,
+		"FlowGridBattery": false,
+		"FlowProductionBattery": true,
+		"FlowProductionGrid": false,
+		"GridFeedIn_W": 3,
+		"IsSystemInstalled": 1,
+		"Pac_total_W": -1220,
+		"Production_W": 1654,
+		"RSOC": 42,
+		"Sac1": 407,
+		"Sac2": 407,
+		"Sac3": 406,
+		"SystemStatus": "OnGrid",
+		"Timestamp": "2024-06-21 12:00:00",
+		"USOC": 38,
+		"Uac": 233,
+		"Ubat": 51
+	}`,
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Operating modes as reported in Status.OperatingMode.
+const (
+	// Manual charging or discharging via setpoints
+	ModeManual = "1"
+	// Automatic self consumption, the default
+	ModeSelfConsumption = "2"
+)
+
+// ErrNoToken is returned by write calls without a token.
+var ErrNoToken = errors.New("write calls require a token")
+
+// send makes a write call and discards the response body.
+func (f *Sonnenbatterie) send(ctx context.Context, method, endpoint string, form url.Values) error {
+	if !f.HasToken() {
+		return ErrNoToken
+	}
+	if err := f.requireV2(ctx); err != nil {
+		return err
+	}
+	req, err := f.newRequest(ctx, method, f.endpointURL(V2, endpoint), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	return nil
+}
+
+// SetOperatingMode switches the operating mode, ModeManual or
+// ModeSelfConsumption (Write API)
+func (f *Sonnenbatterie) SetOperatingMode(ctx context.Context, mode string) error {
+	return f.send(ctx, http.MethodPut, "configurations", url.Values{"EM_OperatingMode": {mode}})
+}
+
+// SetBackupBuffer sets the share of the capacity in percent that is reserved
+// for grid outages (Write API)
+func (f *Sonnenbatterie) SetBackupBuffer(ctx context.Context, percent int) error {
+	return f.send(ctx, http.MethodPut, "configurations", url.Values{"EM_USOC": {strconv.Itoa(percent)}})
+}
+
+// Charge sets a charge setpoint in watts. Only accepted in manual mode
+// (Write API)
+func (f *Sonnenbatterie) Charge(ctx context.Context, watts int) error {
+	return f.send(ctx, http.MethodPost, "setpoint/charge/"+strconv.Itoa(watts), nil)
+}
+
+// Discharge sets a discharge setpoint in watts. Only accepted in manual mode
+// (Write API)
+func (f *Sonnenbatterie) Discharge(ctx context.Context, watts int) error {
+	return f.send(ctx, http.MethodPost, "setpoint/discharge/"+strconv.Itoa(watts), nil)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// FlexFloat is a number that firmware versions send either as JSON number or
+// as numeric string. null and empty strings decode to zero.
+type FlexFloat float64
+
+func (n *FlexFloat) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		b = bytes.TrimSpace([]byte(s))
+		if len(b) == 0 {
+			*n = 0
+			return nil
+		}
+	}
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", b)
+	}
+	*n = FlexFloat(f)
+	return nil
+}
+
+// FlexString is a string that firmware versions send either as JSON string or
+// as number, e.g. "2" and 2 for the operating mode.
+type FlexString string
+
+func (s *FlexString) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var v string
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		*s = FlexString(v)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("invalid string or number %s", b)
+	}
+	*s = FlexString(n.String())
+	return nil
+}
+
+// Float64 parses the string as number.
+func (s FlexString) Float64() (float64, error) {
+	return strconv.ParseFloat(string(s), 64)
+}
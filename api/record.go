@@ -0,0 +1,227 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "REDACTED"
+
+// Recording is a single captured response of the battery API.
+type Recording struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	// RequestHeader holds the headers sent to the battery, with the token
+	// redacted.
+	RequestHeader http.Header   `json:"request_header,omitempty"`
+	Status        int           `json:"status"`
+	Body          string        `json:"body"`
+	Duration      time.Duration `json:"duration"`
+}
+
+// WrapTransport replaces the client with one whose transport is wrapped by
+// wrap. The shared http.DefaultClient is never modified.
+func (f *Sonnenbatterie) WrapTransport(wrap func(http.RoundTripper) http.RoundTripper) {
+	client := *f.Client
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client.Transport = wrap(next)
+	f.Client = &client
+}
+
+// RecordingTransport captures every response passing through it as JSON
+// lines in a file per session. The Auth-Token header is redacted.
+type RecordingTransport struct {
+	// OnError is called when a response could not be recorded. The response
+	// is still returned, recording never fails a battery call.
+	OnError func(error)
+
+	next http.RoundTripper
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewRecordingTransport creates a new session file in dir. Responses are
+// recorded once the transport wraps another one, see Wrap.
+func NewRecordingTransport(dir string) (*RecordingTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, "session-"+time.Now().UTC().Format("20060102T150405")+".jsonl")
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingTransport{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+// Wrap records all responses of next, for use with WrapTransport.
+func (t *RecordingTransport) Wrap(next http.RoundTripper) http.RoundTripper {
+	t.next = next
+	return t
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := req.Header.Clone()
+	if header.Get("Auth-Token") != "" {
+		header.Set("Auth-Token", redacted)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.enc.Encode(Recording{
+		Time:          start,
+		Method:        req.Method,
+		Path:          req.URL.Path,
+		RequestHeader: header,
+		Status:        resp.StatusCode,
+		Body:          string(body),
+		Duration:      time.Since(start),
+	}); err != nil && t.OnError != nil {
+		t.OnError(fmt.Errorf("error recording response: %w", err))
+	}
+	return resp, nil
+}
+
+// Close closes the session file.
+func (t *RecordingTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file.Close()
+}
+
+// ReplayTransport serves recorded responses instead of talking to a
+// battery. Responses are served in recording order per endpoint, so a
+// replayed collector sees the same sequence of values as the original one.
+type ReplayTransport struct {
+	// Loop restarts from the first recording once an endpoint is exhausted
+	Loop bool
+
+	mu         sync.Mutex
+	recordings map[string][]Recording
+	next       map[string]int
+}
+
+// NewReplayTransport loads all session files in dir.
+func NewReplayTransport(dir string) (*ReplayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+
+	var all []Recording
+	for _, name := range files {
+		recordings, err := readRecordings(name)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, recordings...)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+
+	t := &ReplayTransport{
+		recordings: map[string][]Recording{},
+		next:       map[string]int{},
+	}
+	for _, r := range all {
+		key := replayKey(r.Method, r.Path)
+		t.recordings[key] = append(t.recordings[key], r)
+	}
+	return t, nil
+}
+
+func readRecordings(name string) ([]Recording, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var recordings []Recording
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var r Recording
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("error parsing %s:%d: %w", name, line, err)
+		}
+		recordings = append(recordings, r)
+	}
+	return recordings, scanner.Err()
+}
+
+// replayKey identifies an endpoint independent of the host and any proxy
+// prefix in front of the API.
+func replayKey(method, path string) string {
+	if i := strings.Index(path, "/api/"); i >= 0 {
+		path = path[i:]
+	}
+	return method + " " + path
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := replayKey(req.Method, req.URL.Path)
+
+	t.mu.Lock()
+	recordings := t.recordings[key]
+	i := t.next[key]
+	if i >= len(recordings) && t.Loop {
+		i = 0
+	}
+	if i >= len(recordings) {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no more recordings for %s", key)
+	}
+	t.next[key] = i + 1
+	t.mu.Unlock()
+
+	r := recordings[i]
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,113 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/api/apitest"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	a, srv := newClient(t, "secret")
+
+	recorder, err := api.NewRecordingTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.WrapTransport(recorder.Wrap)
+
+	for _, rsoc := range []int{10, 11} {
+		if err := srv.SetPayload(apitest.EndpointStatus, map[string]any{"RSOC": rsoc}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.GetStatus(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.GetLatestData(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("expected one session file, got %v", files)
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "secret") {
+		t.Error("token was not redacted from the recording")
+	}
+	var first api.Recording
+	if err := json.Unmarshal(raw[:bytes.IndexByte(raw, '\n')], &first); err != nil {
+		t.Fatal(err)
+	}
+	if got := first.RequestHeader.Get("Auth-Token"); got != "REDACTED" {
+		t.Errorf("expected the redacted request token, got %q", got)
+	}
+
+	replay, err := api.NewReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := api.NewSonnenbatterie("http://replay.invalid", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed.WrapTransport(func(http.RoundTripper) http.RoundTripper { return replay })
+
+	for _, want := range []api.FlexFloat{10, 11} {
+		status, err := replayed.GetStatus(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Rsoc != want {
+			t.Errorf("expected replayed rsoc %v, got %v", want, status.Rsoc)
+		}
+	}
+	if _, err := replayed.GetStatus(context.Background()); err == nil {
+		t.Error("expected error once recordings are exhausted")
+	}
+
+	latest, err := replayed.GetLatestData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.FullChargeCapacity != 15000 {
+		t.Errorf("unexpected replayed latest data %+v", latest)
+	}
+}
+
+func TestRecordingErrorKeepsResponse(t *testing.T) {
+	a, _ := newClient(t, "")
+	recorder, err := api.NewRecordingTransport(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recordErr error
+	recorder.OnError = func(err error) { recordErr = err }
+	a.WrapTransport(recorder.Wrap)
+	// writes to the closed session file fail
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.GetStatus(context.Background()); err != nil {
+		t.Errorf("expected the battery call to succeed, got %v", err)
+	}
+	if recordErr == nil {
+		t.Error("expected the recording error to be reported")
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SchemaReport lists the differences between a document sent by the battery
+// and the struct it is decoded into. Nested fields are reported with dotted
+// paths, e.g. "ic_status.statebms" or "modules[].cyclecount". Fields tagged
+// omitempty are optional and never reported missing.
+type SchemaReport struct {
+	Endpoint string
+	// Fields sent by the battery that the struct does not know
+	Unknown []string
+	// Fields of the struct that the battery did not send
+	Missing []string
+}
+
+// Equal reports whether both reports list the same fields.
+func (r SchemaReport) Equal(o SchemaReport) bool {
+	return r.Endpoint == o.Endpoint &&
+		strings.Join(r.Unknown, ",") == strings.Join(o.Unknown, ",") &&
+		strings.Join(r.Missing, ",") == strings.Join(o.Missing, ",")
+}
+
+// checkSchema compares the raw document with the json fields of v. Bodies
+// that are not JSON objects or arrays of objects, and types decoding
+// themselves, yield an empty report.
+func checkSchema(endpoint string, body []byte, v any) SchemaReport {
+	unknown := map[string]bool{}
+	missing := map[string]bool{}
+
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice {
+		var docs []json.RawMessage
+		if err := json.Unmarshal(body, &docs); err == nil {
+			for _, doc := range docs {
+				compareFields("", doc, t.Elem(), unknown, missing)
+			}
+		}
+	} else {
+		compareFields("", body, t, unknown, missing)
+	}
+
+	return SchemaReport{
+		Endpoint: endpoint,
+		Unknown:  sortedKeys(unknown),
+		Missing:  sortedKeys(missing),
+	}
+}
+
+func compareFields(prefix string, doc json.RawMessage, t reflect.Type, unknown, missing map[string]bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || implementsUnmarshaler(t) {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return
+	}
+
+	known := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, optional := jsonName(field)
+		if name == "" {
+			continue
+		}
+		known[name] = true
+
+		raw, ok := fields[name]
+		if !ok {
+			if !optional {
+				missing[prefix+name] = true
+			}
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			compareFields(prefix+name+".", raw, field.Type, unknown, missing)
+		case reflect.Slice:
+			var docs []json.RawMessage
+			if err := json.Unmarshal(raw, &docs); err == nil {
+				for _, doc := range docs {
+					compareFields(prefix+name+"[].", doc, field.Type.Elem(), unknown, missing)
+				}
+			}
+		}
+	}
+	for name := range fields {
+		if !known[name] {
+			unknown[prefix+name] = true
+		}
+	}
+}
+
+// jsonName returns the field's name in JSON documents and whether it is
+// optional, i.e. tagged omitempty.
+func jsonName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, strings.Contains(opts, "omitempty")
+}
+
+func implementsUnmarshaler(t reflect.Type) bool {
+	unmarshaler := reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	return t.Implements(unmarshaler) || reflect.PointerTo(t).Implements(unmarshaler)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSOptions configures how the client talks to a battery that is only
+// reachable through an HTTPS endpoint, e.g. a reverse proxy with a private
+// CA or mutual TLS.
+type TLSOptions struct {
+	// PEM bundle with additional CAs to trust besides the system pool
+	CAFile string
+	// PEM client certificate and key for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Overrides the server name used for SNI and certificate verification
+	ServerName string
+	// Disables certificate verification entirely
+	InsecureSkipVerify bool
+}
+
+// IsZero reports whether no TLS option is set.
+func (o TLSOptions) IsZero() bool {
+	return o == TLSOptions{}
+}
+
+// Config builds a tls.Config from the options.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// SetTLS replaces the client with one whose transport uses the given TLS
+// options. The shared http.DefaultClient is never modified.
+func (f *Sonnenbatterie) SetTLS(opts TLSOptions) error {
+	cfg, err := opts.Config()
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+
+	client := *f.Client
+	client.Transport = transport
+	f.Client = &client
+	return nil
+}
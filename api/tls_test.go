@@ -0,0 +1,160 @@
+package api_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/api/apitest"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key, der}
+}
+
+// issue returns a certificate for the DNS name, for servers or clients.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	client := ca.issue(t, "exporter", x509.ExtKeyUsageClientAuth)
+	keyDER, err := x509.MarshalECPrivateKey(client.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", ca.der)
+	certFile := writePEM(t, "client.pem", "CERTIFICATE", client.Certificate[0])
+	keyFile := writePEM(t, "client-key.pem", "EC PRIVATE KEY", keyDER)
+
+	// the certificate is not valid for 127.0.0.1, only with ServerName
+	battery := apitest.NewServer()
+	t.Cleanup(battery.Close)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(battery.Config.Handler)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "battery.local", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	// the failing handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	for _, tc := range []struct {
+		name string
+		opts api.TLSOptions
+		ok   bool
+	}{
+		{"system roots", api.TLSOptions{ServerName: "battery.local", CertFile: certFile, KeyFile: keyFile}, false},
+		{"server name mismatch", api.TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, false},
+		{"no client certificate", api.TLSOptions{CAFile: caFile, ServerName: "battery.local"}, false},
+		{"mutual tls", api.TLSOptions{CAFile: caFile, ServerName: "battery.local", CertFile: certFile, KeyFile: keyFile}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := api.NewSonnenbatterie(srv.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.SetTLS(tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			_, err = a.GetStatus(context.Background())
+			if tc.ok && err != nil {
+				t.Errorf("expected status, got %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected the TLS handshake to fail")
+			}
+		})
+	}
+
+	badCA := filepath.Join(t.TempDir(), "bad-ca.pem")
+	if err := os.WriteFile(badCA, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, opts := range map[string]api.TLSOptions{
+		"cert without key": {CertFile: certFile},
+		"key without cert": {KeyFile: keyFile},
+		"bad ca":           {CAFile: badCA},
+		"missing ca":       {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"mismatched key":   {CertFile: caFile, KeyFile: keyFile},
+	} {
+		if _, err := opts.Config(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Version selects the API generation spoken by the battery.
+type Version int
+
+const (
+	// VersionAuto probes v2 on first use and falls back to v1
+	VersionAuto Version = iota
+	// V1 is the legacy token-less API of older firmware, it only offers status
+	V1
+	V2
+)
+
+func (v Version) String() string {
+	switch v {
+	case V1:
+		return "v1"
+	case V2:
+		return "v2"
+	default:
+		return "auto"
+	}
+}
+
+// ParseVersion parses "auto", "v1" or "v2".
+func ParseVersion(s string) (Version, error) {
+	for _, v := range []Version{VersionAuto, V1, V2} {
+		if s == v.String() {
+			return v, nil
+		}
+	}
+	return VersionAuto, fmt.Errorf("unknown api version %q", s)
+}
+
+// ErrUnsupported is returned for endpoints the legacy v1 API does not offer.
+var ErrUnsupported = errors.New("not supported by the v1 api")
+
+// SetVersion forces the API version, VersionAuto detects it on first use.
+func (f *Sonnenbatterie) SetVersion(v Version) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version = v
+}
+
+// Version returns the API version in use, VersionAuto if it is not yet
+// detected.
+func (f *Sonnenbatterie) Version() Version {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.version
+}
+
+// versionProbe is a running detection of the API version that concurrent
+// callers wait for instead of probing themselves.
+type versionProbe struct {
+	done    chan struct{}
+	version Version
+	err     error
+}
+
+// resolveVersion returns the API version, probing the battery if it is not
+// yet known. The lock is not held during the probe, concurrent callers share
+// its result. Failed probes are retried on the next call.
+func (f *Sonnenbatterie) resolveVersion(ctx context.Context) (Version, error) {
+	f.mu.Lock()
+	if f.version != VersionAuto {
+		defer f.mu.Unlock()
+		return f.version, nil
+	}
+	if p := f.probing; p != nil {
+		f.mu.Unlock()
+		select {
+		case <-p.done:
+			return p.version, p.err
+		case <-ctx.Done():
+			return VersionAuto, ctx.Err()
+		}
+	}
+	p := &versionProbe{done: make(chan struct{})}
+	f.probing = p
+	f.mu.Unlock()
+
+	p.version, p.err = f.detectVersion(ctx)
+
+	f.mu.Lock()
+	// SetVersion may have forced a version in the meantime
+	if p.err == nil && f.version == VersionAuto {
+		f.version = p.version
+	}
+	f.probing = nil
+	f.mu.Unlock()
+	close(p.done)
+	return p.version, p.err
+}
+
+// detectVersion probes v2 and then v1.
+func (f *Sonnenbatterie) detectVersion(ctx context.Context) (Version, error) {
+	for _, v := range []Version{V2, V1} {
+		code, err := f.probe(ctx, v)
+		if err != nil {
+			return VersionAuto, err
+		}
+		if code == http.StatusOK {
+			return v, nil
+		}
+		if code != http.StatusNotFound {
+			return VersionAuto, fmt.Errorf("unexpected http status probing %s api: %d", v, code)
+		}
+	}
+	return VersionAuto, fmt.Errorf("battery offers neither v1 nor v2 api")
+}
+
+func (f *Sonnenbatterie) probe(ctx context.Context, v Version) (int, error) {
+	req, err := f.newRequest(ctx, "GET", f.endpointURL(v, "status"), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (f *Sonnenbatterie) requireV2(ctx context.Context) error {
+	version, err := f.resolveVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version != V2 {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// statusV1 is the status document of the legacy API. It lacks the
+// configuration and capacity fields of v2.
+type statusV1 struct {
+	BatteryCharging           bool      `json:"BatteryCharging"`
+	BatteryDischarging        bool      `json:"BatteryDischarging"`
+	ConsumptionW              int       `json:"Consumption_W"`
+	Fac                       float64   `json:"Fac"`
+	FlowConsumptionBattery    bool      `json:"FlowConsumptionBattery"`
+	FlowConsumptionGrid       bool      `json:"FlowConsumptionGrid"`
+	FlowConsumptionProduction bool      `json:"FlowConsumptionProduction"`
+	FlowGridBattery           bool      `json:"FlowGridBattery"`
+	FlowProductionBattery     bool      `json:"FlowProductionBattery"`
+	FlowProductionGrid        bool      `json:"FlowProductionGrid"`
+	GridFeedInW               float64   `json:"GridFeedIn_W"`
+	IsSystemInstalled         int       `json:"IsSystemInstalled"`
+	PacTotalW                 int       `json:"Pac_total_W"`
+	ProductionW               int       `json:"Production_W"`
+	Rsoc                      FlexFloat `json:"RSOC"`
+	Sac1                      int       `json:"Sac1"`
+	Sac2                      int       `json:"Sac2"`
+	Sac3                      int       `json:"Sac3"`
+	SystemStatus              string    `json:"SystemStatus"`
+	Timestamp                 string    `json:"Timestamp"`
+	Usoc                      FlexFloat `json:"USOC"`
+	Uac                       float64   `json:"Uac"`
+	Ubat                      float64   `json:"Ubat"`
+}
+
+func (f *Sonnenbatterie) getStatusV1(ctx context.Context) (*Status, error) {
+	var v1 statusV1
+	if err := f.get(ctx, V1, "status", "status", &v1); err != nil {
+		return nil, err
+	}
+	return &Status{
+		BatteryCharging:           v1.BatteryCharging,
+		BatteryDischarging:        v1.BatteryDischarging,
+		ConsumptionW:              v1.ConsumptionW,
+		Fac:                       v1.Fac,
+		FlowConsumptionBattery:    v1.FlowConsumptionBattery,
+		FlowConsumptionGrid:       v1.FlowConsumptionGrid,
+		FlowConsumptionProduction: v1.FlowConsumptionProduction,
+		FlowGridBattery:           v1.FlowGridBattery,
+		FlowProductionBattery:     v1.FlowProductionBattery,
+		FlowProductionGrid:        v1.FlowProductionGrid,
+		GridFeedInW:               v1.GridFeedInW,
+		IsSystemInstalled:         v1.IsSystemInstalled,
+		PacTotalW:                 v1.PacTotalW,
+		ProductionW:               v1.ProductionW,
+		Rsoc:                      v1.Rsoc,
+		Sac1:                      v1.Sac1,
+		Sac2:                      v1.Sac2,
+		Sac3:                      v1.Sac3,
+		SystemStatus:              v1.SystemStatus,
+		Timestamp:                 v1.Timestamp,
+		Usoc:                      v1.Usoc,
+		Uac:                       v1.Uac,
+		Ubat:                      v1.Ubat,
+	}, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+// thresholds are the limits of the cell balance and temperature checks.
+type thresholds struct {
+	// maximum difference between the highest and lowest cell voltage
+	CellVoltageSpread float64
+	// maximum difference between the warmest and coldest cell
+	CellTemperatureDelta float64
+	// warmest and coldest allowed cell temperature
+	CellTemperatureMax float64
+	CellTemperatureMin float64
+}
+
+func defaultThresholds() thresholds {
+	return thresholds{
+		CellVoltageSpread:    0.1,
+		CellTemperatureDelta: 10,
+		CellTemperatureMax:   45,
+		CellTemperatureMin:   5,
+	}
+}
+
+// thresholdChecks compare a value of the battery module data against its
+// limit. Checks with below set fail if the value is lower than the limit,
+// all others if it is higher.
+var thresholdChecks = []thresholdCheck{
+	{"cell_voltage_spread", cellVoltageSpread, func(t thresholds) float64 { return t.CellVoltageSpread }, false},
+	{"cell_temperature_delta", cellTemperatureDelta, func(t thresholds) float64 { return t.CellTemperatureDelta }, false},
+	{"cell_temperature_high", func(b *api.BatteryModuleData) float64 { return b.MaximumCellTemperature }, func(t thresholds) float64 { return t.CellTemperatureMax }, false},
+	{"cell_temperature_low", func(b *api.BatteryModuleData) float64 { return b.MinimumCellTemperature }, func(t thresholds) float64 { return t.CellTemperatureMin }, true},
+}
+
+type thresholdCheck struct {
+	name  string
+	value func(*api.BatteryModuleData) float64
+	limit func(thresholds) float64
+	below bool
+}
+
+func (c thresholdCheck) exceeded(b *api.BatteryModuleData, t thresholds) bool {
+	if c.below {
+		return c.value(b) < c.limit(t)
+	}
+	return c.value(b) > c.limit(t)
+}
+
+// exceeded returns the names of the failed checks.
+func (t thresholds) exceeded(b *api.BatteryModuleData) []string {
+	var failed []string
+	for _, c := range thresholdChecks {
+		if c.exceeded(b, t) {
+			failed = append(failed, c.name)
+		}
+	}
+	return failed
+}
+
+func cellVoltageSpread(b *api.BatteryModuleData) float64 {
+	return b.MaximumCellVoltage - b.MinimumCellVoltage
+}
+
+func cellTemperatureDelta(b *api.BatteryModuleData) float64 {
+	return b.MaximumCellTemperature - b.MinimumCellTemperature
+}
+
+// balanceDoc is the battery module data with the configured thresholds.
+type balanceDoc struct {
+	*api.BatteryModuleData
+	limits thresholds
+}
+
+var balanceMetrics = metricTable[*balanceDoc]{
+	{"solar_battery_cell_voltage_spread_volts", "Difference between the highest and lowest cell voltage in volts", "volts", gauge, nil, func(b *balanceDoc) []sample { return one(cellVoltageSpread(b.BatteryModuleData)) }},
+	{"solar_battery_cell_temperature_delta_celsius", "Difference between the warmest and coldest cell in degrees celsius", "celsius", gauge, nil, func(b *balanceDoc) []sample { return one(cellTemperatureDelta(b.BatteryModuleData)) }},
+	{"solar_battery_module_cell_voltage_spread_volts", "Difference between the highest and lowest cell voltage of a single battery module in volts", "volts", gauge, []string{"module"}, func(b *balanceDoc) []sample {
+		return perModule(func(m api.BatteryModule) float64 { return m.MaximumCellVoltage - m.MinimumCellVoltage })(b.BatteryModuleData)
+	}},
+	{"solar_battery_module_cell_temperature_delta_celsius", "Difference between the warmest and coldest cell of a single battery module in degrees celsius", "celsius", gauge, []string{"module"}, func(b *balanceDoc) []sample {
+		return perModule(func(m api.BatteryModule) float64 { return m.MaximumCellTemperature - m.MinimumCellTemperature })(b.BatteryModuleData)
+	}},
+	{"solar_battery_threshold_limit", "Configured limit of a cell balance or temperature check", "", gauge, []string{"check"}, func(b *balanceDoc) []sample {
+		samples := make([]sample, len(thresholdChecks))
+		for i, c := range thresholdChecks {
+			samples[i] = sample{c.limit(b.limits), []string{c.name}}
+		}
+		return samples
+	}},
+	{"solar_battery_threshold_exceeded", "Whether a cell balance or temperature check is outside its limit, 1 if exceeded", "", gauge, []string{"check"}, func(b *balanceDoc) []sample {
+		samples := make([]sample, len(thresholdChecks))
+		for i, c := range thresholdChecks {
+			var v float64
+			if c.exceeded(b.BatteryModuleData, b.limits) {
+				v = 1
+			}
+			samples[i] = sample{v, []string{c.name}}
+		}
+		return samples
+	}},
+}
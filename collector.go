@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+type collector struct {
+	api *api.Sonnenbatterie
+	// location of the battery's clock, nil if unknown. The battery's time
+	// is only exported and used as reference with a known location.
+	location *time.Location
+
+	// enabled collector sections by name, see collectorSections
+	enabled map[string]bool
+	// limits of the cell balance and temperature checks
+	limits thresholds
+	// snapshot returns the last poll of the background poller, nil if it
+	// does not run or has not polled yet. Scrapes then read the polled
+	// sections from it instead of querying the battery again.
+	snapshot func() *poller.Snapshot
+}
+
+func newCollector(api *api.Sonnenbatterie, location *time.Location) *collector {
+	return &collector{
+		api:      api,
+		location: location,
+		enabled:  defaultSections(),
+		limits:   defaultThresholds(),
+	}
+}
+
+// Describe implements Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, section := range collectorSections {
+		for _, name := range descriptors.sections[section.name] {
+			ch <- descriptors.descs[name]
+		}
+	}
+}
+
+// collectStatus returns the battery's system time, which is zero if the
+// status or its timestamp could not be read or the location is unknown.
+func (c *collector) collectStatus(ch chan<- prometheus.Metric) time.Time {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	status, err := c.api.GetStatus(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get status")
+		return time.Time{}
+	}
+	return c.collectStatusDoc(ch, status, time.Now())
+}
+
+// collectStatusDoc exports the status fetched at the exporter's time fetched
+// and returns the battery's system time, see collectStatus.
+func (c *collector) collectStatusDoc(ch chan<- prometheus.Metric, status *api.Status, fetched time.Time) time.Time {
+	doc := &statusDoc{Status: status, fetched: fetched}
+	if c.location != nil {
+		var err error
+		if doc.time, err = status.Time(c.location); err != nil {
+			log.Warn().Err(err).Str("timestamp", status.Timestamp).Msg("failed to parse battery time")
+			doc.time = time.Time{}
+		}
+	}
+	statusMetrics.collect(ch, doc)
+	derivedMetrics.collect(ch, doc)
+	return doc.time
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func (c *collector) collectPowerMeter(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	production, consumption, err := c.api.GetPowerMeter(ctx)
+	if err != nil {
+		logFetchError(err, "failed to get power meter")
+		return
+	}
+
+	powerMeterMetrics.collect(ch, &powerMeters{production: production, consumption: consumption})
+}
+
+// collectLatestData derives timestamps relative to the battery's system time
+// now, falling back to the exporter's clock if it is unknown.
+func (c *collector) collectLatestData(ch chan<- prometheus.Metric, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	latestData, err := c.api.GetLatestData(ctx)
+	if err != nil {
+		logFetchError(err, "failed to get latest data")
+		return
+	}
+
+	if now.IsZero() {
+		now = time.Now()
+	}
+	latestDataMetrics.collect(ch, &latestDataDoc{LatestData: latestData, now: now})
+}
+
+func (c *collector) collectBatteryModuleData(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	battery_module, err := c.api.GetBatteryModuleData(ctx)
+	if err != nil {
+		logFetchError(err, "failed to get status")
+		return
+	}
+	c.collectBatteryDoc(ch, battery_module)
+}
+
+func (c *collector) collectBatteryDoc(ch chan<- prometheus.Metric, b *api.BatteryModuleData) {
+	batteryMetrics.collect(ch, b)
+	balanceMetrics.collect(ch, &balanceDoc{b, c.limits})
+}
+
+func (c *collector) collectInverter(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	inverter, err := c.api.GetInverter(ctx)
+	if err != nil {
+		logFetchError(err, "failed to get inverter")
+	} else {
+		inverterMetrics.collect(ch, inverter)
+	}
+
+	io, err := c.api.GetIO(ctx)
+	if err != nil {
+		logFetchError(err, "failed to get io")
+		return
+	}
+	ioMetrics.collect(ch, io)
+}
+
+// logFetchError logs a failed fetch of a section. Sections the battery's API
+// version does not offer are skipped quietly.
+func logFetchError(err error, msg string) {
+	if errors.Is(err, api.ErrUnsupported) {
+		log.Debug().Err(err).Msg(msg)
+		return
+	}
+	log.Error().Err(err).Msg(msg)
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	if c.snapshot != nil {
+		if s := c.snapshot(); s != nil {
+			c.collectSnapshot(ch, s)
+			return
+		}
+	}
+
+	var deviceTime time.Time
+	if c.enabled["status"] {
+		deviceTime = c.collectStatus(ch)
+	}
+	if !c.api.HasToken() {
+		return
+	}
+	if c.enabled["powermeter"] {
+		c.collectPowerMeter(ch)
+	}
+	if c.enabled["latestdata"] {
+		c.collectLatestData(ch, deviceTime)
+	}
+	if c.enabled["battery"] {
+		c.collectBatteryModuleData(ch)
+	}
+	if c.enabled["inverter"] {
+		c.collectInverter(ch)
+	}
+}
+
+// collectSnapshot exports the sections fetched by the poller from its
+// snapshot. Sections that failed are left out, as when scraped directly.
+// The inverter is not polled and still queried.
+func (c *collector) collectSnapshot(ch chan<- prometheus.Metric, s *poller.Snapshot) {
+	var deviceTime time.Time
+	if c.enabled["status"] && s.Status != nil {
+		deviceTime = c.collectStatusDoc(ch, s.Status, s.Fetched[poller.EndpointStatus])
+	}
+	if c.enabled["powermeter"] && s.Production != nil {
+		powerMeterMetrics.collect(ch, &powerMeters{production: s.Production, consumption: s.Consumption})
+	}
+	if c.enabled["latestdata"] && s.LatestData != nil {
+		now := deviceTime
+		if now.IsZero() {
+			now = s.Fetched[poller.EndpointLatestData]
+		}
+		latestDataMetrics.collect(ch, &latestDataDoc{LatestData: s.LatestData, now: now})
+	}
+	if c.enabled["battery"] && s.Battery != nil {
+		c.collectBatteryDoc(ch, s.Battery)
+	}
+	if c.enabled["inverter"] && c.api.HasToken() {
+		c.collectInverter(ch)
+	}
+}
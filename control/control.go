@@ -0,0 +1,318 @@
+// Package control exposes the battery's write calls over the exporter's HTTP
+// server, so home automation can drive the battery without holding the
+// battery's own token.
+//
+// Requests authenticate with bearer tokens that are separate from the
+// battery token and carry a role. Every request is written to an audit log;
+// the battery is only called once the request was.
+package control
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+// Role grants a set of actions.
+type Role string
+
+const (
+	// RoleSetpoint may charge and discharge
+	RoleSetpoint Role = "setpoint"
+	// RoleAdmin may additionally switch the operating mode and change the
+	// backup buffer
+	RoleAdmin Role = "admin"
+)
+
+// Battery are the write calls of the battery.
+type Battery interface {
+	Charge(ctx context.Context, watts int) error
+	Discharge(ctx context.Context, watts int) error
+	SetOperatingMode(ctx context.Context, mode string) error
+	SetBackupBuffer(ctx context.Context, percent int) error
+}
+
+// Options configures the gateway.
+type Options struct {
+	// Tokens maps bearer tokens to their role
+	Tokens map[string]Role
+	// Limits of the setpoints in watts
+	MaxChargeW    int
+	MaxDischargeW int
+	// AuditLog receives JSON lines for every request, may be nil
+	AuditLog io.Writer
+	// OnAuditError is called when an entry could not be written to the
+	// audit log
+	OnAuditError func(error)
+}
+
+// Gateway serves the control endpoints.
+type Gateway struct {
+	battery Battery
+	opts    Options
+
+	mu sync.Mutex
+}
+
+// New creates a gateway for the battery.
+func New(battery Battery, opts Options) *Gateway {
+	return &Gateway{battery: battery, opts: opts}
+}
+
+// LoadTokens reads a file with one "<role> <token>" pair per line. Empty
+// lines and lines starting with # are ignored.
+func LoadTokens(path string) (map[string]Role, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading control tokens: %w", err)
+	}
+	defer f.Close()
+
+	tokens := map[string]Role{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		role, token, ok := strings.Cut(line, " ")
+		token = strings.TrimSpace(token)
+		if !ok || token == "" {
+			return nil, fmt.Errorf("%s:%d: expected <role> <token>", path, n)
+		}
+		switch Role(role) {
+		case RoleSetpoint, RoleAdmin:
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown role %q", path, n, role)
+		}
+		tokens[token] = Role(role)
+	}
+	return tokens, scanner.Err()
+}
+
+// modes maps the accepted names of operating modes, including the battery's
+// own values, to the battery's values.
+var modes = map[string]string{
+	"manual":                api.ModeManual,
+	"self-consumption":      api.ModeSelfConsumption,
+	api.ModeManual:          api.ModeManual,
+	api.ModeSelfConsumption: api.ModeSelfConsumption,
+}
+
+// action is a control endpoint.
+type action struct {
+	name string
+	role Role
+	// prepare validates the request body and returns the write call
+	prepare func(g *Gateway, body []byte) (params any, call func(context.Context) error, err error)
+}
+
+var actions = []action{
+	{"charge", RoleSetpoint, func(g *Gateway, body []byte) (any, func(context.Context) error, error) {
+		var req struct {
+			Watts int `json:"watts"`
+		}
+		if err := decode(body, &req); err != nil {
+			return nil, nil, err
+		}
+		if req.Watts < 0 || req.Watts > g.opts.MaxChargeW {
+			return req, nil, badRequest("watts must be between 0 and %d", g.opts.MaxChargeW)
+		}
+		return req, func(ctx context.Context) error { return g.battery.Charge(ctx, req.Watts) }, nil
+	}},
+	{"discharge", RoleSetpoint, func(g *Gateway, body []byte) (any, func(context.Context) error, error) {
+		var req struct {
+			Watts int `json:"watts"`
+		}
+		if err := decode(body, &req); err != nil {
+			return nil, nil, err
+		}
+		if req.Watts < 0 || req.Watts > g.opts.MaxDischargeW {
+			return req, nil, badRequest("watts must be between 0 and %d", g.opts.MaxDischargeW)
+		}
+		return req, func(ctx context.Context) error { return g.battery.Discharge(ctx, req.Watts) }, nil
+	}},
+	{"mode", RoleAdmin, func(g *Gateway, body []byte) (any, func(context.Context) error, error) {
+		var req struct {
+			Mode string `json:"mode"`
+		}
+		if err := decode(body, &req); err != nil {
+			return nil, nil, err
+		}
+		mode, ok := modes[req.Mode]
+		if !ok {
+			return req, nil, badRequest("mode must be manual or self-consumption")
+		}
+		return req, func(ctx context.Context) error { return g.battery.SetOperatingMode(ctx, mode) }, nil
+	}},
+	{"backup-buffer", RoleAdmin, func(g *Gateway, body []byte) (any, func(context.Context) error, error) {
+		var req struct {
+			Percent int `json:"percent"`
+		}
+		if err := decode(body, &req); err != nil {
+			return nil, nil, err
+		}
+		if req.Percent < 0 || req.Percent > 100 {
+			return req, nil, badRequest("percent must be between 0 and 100")
+		}
+		return req, func(ctx context.Context) error { return g.battery.SetBackupBuffer(ctx, req.Percent) }, nil
+	}},
+}
+
+// badRequest returns a validation error, answered with 400.
+func badRequest(format string, args ...any) error {
+	return fmt.Errorf(format, args...)
+}
+
+func decode(body []byte, v any) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return badRequest("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// Register mounts POST /api/control/<action> for every action.
+func (g *Gateway) Register(mux *http.ServeMux) {
+	for _, a := range actions {
+		mux.HandleFunc("POST /api/control/"+a.name, func(w http.ResponseWriter, r *http.Request) {
+			g.serve(w, r, a)
+		})
+	}
+}
+
+// serve audits the accepted request before the write call and the result of
+// every request. No write call is made unless the request was audited.
+func (g *Gateway) serve(w http.ResponseWriter, r *http.Request, a action) {
+	entry := auditEntry{Time: time.Now().UTC(), Remote: r.RemoteAddr, Action: a.name}
+	defer func() {
+		entry.Stage = stageResult
+		_ = g.audit(entry)
+	}()
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	role, known := g.role(token)
+	if !ok || !known {
+		entry.Status, entry.Error = http.StatusUnauthorized, "invalid token"
+		w.Header().Set("WWW-Authenticate", `Bearer realm="control"`)
+		writeJSON(w, entry.Status, entry.Error)
+		return
+	}
+	entry.Role, entry.Token = role, fingerprint(token)
+	if role != RoleAdmin && role != a.role {
+		entry.Status, entry.Error = http.StatusForbidden, fmt.Sprintf("role %s may not %s", role, a.name)
+		writeJSON(w, entry.Status, entry.Error)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<10))
+	if err != nil {
+		entry.Status, entry.Error = http.StatusBadRequest, err.Error()
+		writeJSON(w, entry.Status, entry.Error)
+		return
+	}
+	params, call, err := a.prepare(g, body)
+	entry.Params = params
+	if err != nil {
+		entry.Status, entry.Error = http.StatusBadRequest, err.Error()
+		writeJSON(w, entry.Status, entry.Error)
+		return
+	}
+	request := entry
+	request.Stage = stageRequest
+	if err := g.audit(request); err != nil {
+		entry.Status, entry.Error = http.StatusInternalServerError, "audit log unavailable"
+		writeJSON(w, entry.Status, entry.Error)
+		return
+	}
+	if err := call(r.Context()); err != nil {
+		entry.Status, entry.Error = http.StatusBadGateway, err.Error()
+		writeJSON(w, entry.Status, entry.Error)
+		return
+	}
+	entry.Status = http.StatusOK
+	writeJSON(w, entry.Status, "")
+}
+
+// role looks the token up in constant time.
+func (g *Gateway) role(token string) (Role, bool) {
+	var found Role
+	for t, role := range g.opts.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = role
+		}
+	}
+	return found, found != ""
+}
+
+// fingerprint identifies a token in the audit log without revealing it.
+func fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Stages of audit entries.
+const (
+	// stageRequest is written for an accepted request before the write call
+	stageRequest = "request"
+	// stageResult is written for every request once it is answered
+	stageResult = "result"
+)
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Stage  string    `json:"stage"`
+	Remote string    `json:"remote"`
+	Action string    `json:"action"`
+	Role   Role      `json:"role,omitempty"`
+	Token  string    `json:"token,omitempty"`
+	Params any       `json:"params,omitempty"`
+	Status int       `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// audit writes the entry and reports failures to OnAuditError.
+func (g *Gateway) audit(entry auditEntry) error {
+	if g.opts.AuditLog == nil {
+		return nil
+	}
+	err := g.writeAudit(entry)
+	if err != nil && g.opts.OnAuditError != nil {
+		g.opts.OnAuditError(err)
+	}
+	return err
+}
+
+func (g *Gateway) writeAudit(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding audit entry: %w", err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, err := g.opts.AuditLog.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing audit log: %w", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, errMsg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	resp := struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}{errMsg == "", errMsg}
+	_ = json.NewEncoder(w).Encode(resp)
+}
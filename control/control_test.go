@@ -0,0 +1,153 @@
+package control_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/control"
+	"github.com/joconcepts/sonnenbatterie-exporter/simulator"
+)
+
+func TestGateway(t *testing.T) {
+	battery := httptest.NewServer(simulator.New(simulator.DefaultConfig(), time.Now).Handler("token"))
+	t.Cleanup(battery.Close)
+	a, err := api.NewSonnenbatterie(battery.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokensFile := filepath.Join(t.TempDir(), "tokens")
+	tokens := "# control tokens\nsetpoint automation\nadmin operator\n"
+	if err := os.WriteFile(tokensFile, []byte(tokens), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := control.LoadTokens(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var audit bytes.Buffer
+	mux := http.NewServeMux()
+	control.New(a, control.Options{
+		Tokens:        loaded,
+		MaxChargeW:    3000,
+		MaxDischargeW: 3000,
+		AuditLog:      &audit,
+	}).Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	post := func(action, token, body string, code int) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/control/"+action, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("expected %d for %s %s, got %s", code, action, body, resp.Status)
+		}
+	}
+
+	post("charge", "", `{"watts":1000}`, http.StatusUnauthorized)
+	post("charge", "token", `{"watts":1000}`, http.StatusUnauthorized)
+	post("mode", "automation", `{"mode":"manual"}`, http.StatusForbidden)
+	// the battery rejects setpoints outside of manual mode
+	post("charge", "automation", `{"watts":1000}`, http.StatusBadGateway)
+	post("mode", "operator", `{"mode":"manual"}`, http.StatusOK)
+	post("charge", "automation", `{"watts":3500}`, http.StatusBadRequest)
+	post("charge", "automation", `{"watts":2000}`, http.StatusOK)
+	post("backup-buffer", "operator", `{"percent":120}`, http.StatusBadRequest)
+	post("backup-buffer", "operator", `{"percent":20}`, http.StatusOK)
+
+	status, err := a.GetStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.OperatingMode != api.ModeManual || status.PacTotalW != -2000 || status.BackupBuffer != "20" {
+		t.Errorf("unexpected status: mode %s, power %d, buffer %s", status.OperatingMode, status.PacTotalW, status.BackupBuffer)
+	}
+
+	var entries []map[string]any
+	for line := range strings.Lines(audit.String()) {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	// a result for every request, preceded by the request for the 4 write
+	// calls
+	if len(entries) != 13 {
+		t.Fatalf("expected 13 audit entries, got %d", len(entries))
+	}
+	if request := entries[11]; request["stage"] != "request" || request["action"] != "backup-buffer" || request["status"] != nil {
+		t.Errorf("unexpected audit entry %v", request)
+	}
+	if last := entries[12]; last["stage"] != "result" || last["action"] != "backup-buffer" || last["role"] != "admin" || last["status"] != 200.0 {
+		t.Errorf("unexpected audit entry %v", last)
+	}
+	if strings.Contains(audit.String(), "operator") {
+		t.Error("audit log contains a token")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, os.ErrClosed }
+
+func TestGatewayAuditFailure(t *testing.T) {
+	sim := simulator.New(simulator.DefaultConfig(), time.Now)
+	battery := httptest.NewServer(sim.Handler("token"))
+	t.Cleanup(battery.Close)
+	a, err := api.NewSonnenbatterie(battery.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failures int
+	mux := http.NewServeMux()
+	control.New(a, control.Options{
+		Tokens:       map[string]control.Role{"operator": control.RoleAdmin},
+		AuditLog:     failingWriter{},
+		OnAuditError: func(error) { failures++ },
+	}).Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/control/backup-buffer", strings.NewReader(`{"percent":20}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer operator")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500 without an audit log, got %s", resp.Status)
+	}
+	// the request and its result
+	if failures != 2 {
+		t.Errorf("expected 2 reported audit failures, got %d", failures)
+	}
+	if status := sim.Status(); status.BackupBuffer != "10" {
+		t.Errorf("expected no write call, got backup buffer %s", status.BackupBuffer)
+	}
+}
@@ -0,0 +1,36 @@
+// Package dashboard serves the live dashboard on the exporter's landing page.
+// All assets are embedded, so it works without internet access.
+package dashboard
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed index.html
+var indexHTML string
+
+//go:embed static
+var static embed.FS
+
+var index = template.Must(template.New("index").Parse(indexHTML))
+
+// Options configures the dashboard.
+type Options struct {
+	MetricsPath string
+	// StreamPath is the Server-Sent Events endpoint of the poller, empty if
+	// the poller is disabled
+	StreamPath string
+}
+
+// Register mounts the dashboard on / and its assets on /static/.
+func Register(mux *http.ServeMux, opts Options) {
+	assets, _ := fs.Sub(static, "static")
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(assets)))
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = index.Execute(w, opts)
+	})
+}
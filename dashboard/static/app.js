@@ -0,0 +1,64 @@
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+function set(id, value, digits = 0) {
+	$(id).textContent = value === undefined || value === null ? "–" : Number(value).toFixed(digits);
+}
+
+function pill(id, text, state) {
+	const el = $(id);
+	el.textContent = text;
+	el.className = "pill " + state;
+}
+
+function render(s) {
+	$("updated").textContent = "updated " + new Date(s.time).toLocaleTimeString();
+	const st = s.status;
+	if (st) {
+		pill("grid", st.SystemStatus || "–", st.SystemStatus === "OnGrid" ? "ok" : "bad");
+		pill("mode", st.OperatingMode === "1" ? "manual" : st.OperatingMode === "2" ? "self consumption" : "mode " + st.OperatingMode, "");
+		set("usoc", st.USOC);
+		$("usoc-bar").style.width = Math.max(0, Math.min(100, st.USOC)) + "%";
+		set("remaining", st.RemainingCapacity_Wh);
+		set("buffer", st.BackupBuffer);
+		set("production", st.Production_W);
+		set("consumption", st.Consumption_W);
+		set("grid-power", Math.abs(st.GridFeedIn_W));
+		$("grid-label").textContent = st.GridFeedIn_W >= 0 ? "Grid export" : "Grid import";
+		set("battery-power", Math.abs(st.Pac_total_W));
+		$("battery-label").textContent = st.Pac_total_W > 0 ? "Battery discharging" : st.Pac_total_W < 0 ? "Battery charging" : "Battery idle";
+	} else {
+		pill("grid", "unreachable", "bad");
+	}
+
+	for (const [name, meter] of [["production", s.production], ["consumption", s.consumption]]) {
+		for (const l of [1, 2, 3]) {
+			set(`${name}-l${l}`, meter ? meter["w_l" + l] : null);
+		}
+	}
+	const volts = s.consumption || s.production;
+	for (const l of [1, 2, 3]) {
+		set(`voltage-l${l}`, volts ? volts[`v_l${l}_n`] : null, 1);
+	}
+
+	const alarms = [];
+	if (s.battery && s.battery.systemalarm) alarms.push("System alarm " + s.battery.systemalarm);
+	if (s.battery && s.battery.systemwarning) alarms.push("System warning " + s.battery.systemwarning);
+	if (st && st.dischargeNotAllowed) alarms.push("Discharging not allowed");
+	for (const [endpoint, err] of Object.entries(s.errors || {})) alarms.push(`${endpoint}: ${err}`);
+	const list = $("alarms");
+	list.replaceChildren(...(alarms.length ? alarms : ["none"]).map((text) => {
+		const li = document.createElement("li");
+		li.textContent = text;
+		li.className = alarms.length ? "bad" : "muted";
+		return li;
+	}));
+}
+
+const stream = document.body.dataset.stream;
+if (stream) {
+	const events = new EventSource(stream);
+	events.addEventListener("snapshot", (e) => render(JSON.parse(e.data)));
+	events.onerror = () => { $("updated").textContent = "reconnecting…"; };
+}
@@ -0,0 +1,81 @@
+package datalog
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+// column is one logged value, named <document>.<json field>.
+type column struct {
+	name  string
+	value func(*poller.Snapshot) any
+}
+
+// columns are derived once from the api structs, in field order, so the set
+// only changes when the structs do.
+var columns = buildColumns()
+
+func buildColumns() []column {
+	cols := []column{{"time", nil}}
+	cols = append(cols, fields("status", reflect.TypeOf(api.Status{}), func(s *poller.Snapshot) any { return s.Status })...)
+	cols = append(cols, fields("production", reflect.TypeOf(api.PowerMeter{}), func(s *poller.Snapshot) any { return s.Production })...)
+	cols = append(cols, fields("consumption", reflect.TypeOf(api.PowerMeter{}), func(s *poller.Snapshot) any { return s.Consumption })...)
+	cols = append(cols, fields("battery", reflect.TypeOf(api.BatteryModuleData{}), func(s *poller.Snapshot) any { return s.Battery })...)
+	return cols
+}
+
+// fields returns a column per scalar field of t. Nested structs and slices,
+// like the per module battery data, are left out to keep the set stable.
+func fields(prefix string, t reflect.Type, doc func(*poller.Snapshot) any) []column {
+	var cols []column
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64, reflect.String:
+		default:
+			continue
+		}
+		index := i
+		cols = append(cols, column{prefix + "." + name, func(s *poller.Snapshot) any {
+			v := reflect.ValueOf(doc(s))
+			if v.IsNil() {
+				return nil
+			}
+			return v.Elem().Field(index).Interface()
+		}})
+	}
+	return cols
+}
+
+// Columns returns the names of the logged columns.
+func Columns() []string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+// format renders a value as CSV cell, empty if the document is missing.
+func format(v any) string {
+	switch v := reflect.ValueOf(v); v.Kind() {
+	case reflect.Invalid:
+		return ""
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	default:
+		return v.String()
+	}
+}
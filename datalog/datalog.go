@@ -0,0 +1,221 @@
+// Package datalog appends the polled snapshots to daily rotated CSV or
+// NDJSON files for ad-hoc analysis in spreadsheets and pandas.
+package datalog
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+// Supported formats.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+const (
+	filePrefix = "sonnenbatterie-"
+	dayLayout  = "2006-01-02"
+)
+
+// Options configures the logger.
+type Options struct {
+	Dir    string
+	Format string
+	// files of days older than this are deleted, 0 keeps all
+	Retention time.Duration
+	// compress the files of past days
+	Gzip bool
+	// time zone of the day boundaries
+	Location *time.Location
+}
+
+// Logger writes one line per snapshot to the file of the snapshot's day.
+type Logger struct {
+	opts Options
+	day  string
+	file *os.File
+}
+
+// New creates the directory and cleans up files left by previous runs.
+func New(opts Options) (*Logger, error) {
+	if opts.Format != FormatCSV && opts.Format != FormatNDJSON {
+		return nil, fmt.Errorf("unknown data log format %q", opts.Format)
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating data log directory: %w", err)
+	}
+	l := &Logger{opts: opts}
+	if err := l.cleanup(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) path(day string) string {
+	return filepath.Join(l.opts.Dir, filePrefix+day+"."+l.opts.Format)
+}
+
+// Write appends the snapshot, rotating to a new file on day change.
+func (l *Logger) Write(s *poller.Snapshot) error {
+	day := s.Time.In(l.opts.Location).Format(dayLayout)
+	if day != l.day {
+		if err := l.rotate(day, s.Time); err != nil {
+			return err
+		}
+	}
+
+	var line []byte
+	switch l.opts.Format {
+	case FormatCSV:
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		record := make([]string, len(columns))
+		record[0] = s.Time.UTC().Format(time.RFC3339)
+		for i, c := range columns[1:] {
+			record[i+1] = format(c.value(s))
+		}
+		_ = w.Write(record)
+		w.Flush()
+		line = []byte(b.String())
+	case FormatNDJSON:
+		record := make(map[string]any, len(columns))
+		record["time"] = s.Time.UTC()
+		for _, c := range columns[1:] {
+			if v := c.value(s); v != nil {
+				record[c.name] = v
+			}
+		}
+		var err error
+		if line, err = json.Marshal(record); err != nil {
+			return err
+		}
+		line = append(line, '\n')
+	}
+	if _, err := l.file.Write(line); err != nil {
+		return fmt.Errorf("error writing data log: %w", err)
+	}
+	return nil
+}
+
+// rotate opens the file of day, writing the CSV header into new files, and
+// compresses and prunes the files of previous days.
+func (l *Logger) rotate(day string, now time.Time) error {
+	if err := l.Close(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path(day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening data log: %w", err)
+	}
+	l.file, l.day = f, day
+
+	if info, err := f.Stat(); err == nil && info.Size() == 0 && l.opts.Format == FormatCSV {
+		w := csv.NewWriter(f)
+		_ = w.Write(Columns())
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("error writing data log: %w", err)
+		}
+	}
+	return l.cleanup(now)
+}
+
+// cleanup deletes files past the retention and compresses the files of
+// previous days.
+func (l *Logger) cleanup(now time.Time) error {
+	entries, err := os.ReadDir(l.opts.Dir)
+	if err != nil {
+		return fmt.Errorf("error reading data log directory: %w", err)
+	}
+	today := now.In(l.opts.Location).Format(dayLayout)
+	for _, e := range entries {
+		name := e.Name()
+		rest, ok := strings.CutPrefix(name, filePrefix)
+		if !ok || len(rest) < len(dayLayout) {
+			continue
+		}
+		day := rest[:len(dayLayout)]
+		date, err := time.ParseInLocation(dayLayout, day, l.opts.Location)
+		if err != nil || day == today || day == l.day {
+			continue
+		}
+		path := filepath.Join(l.opts.Dir, name)
+		if l.opts.Retention > 0 && now.Sub(date.AddDate(0, 0, 1)) > l.opts.Retention {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error deleting old data log: %w", err)
+			}
+			continue
+		}
+		if l.opts.Gzip && !strings.HasSuffix(name, ".gz") {
+			if err := compress(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compress replaces the file with its gzipped version.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return fmt.Errorf("error compressing data log: %w", err)
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error compressing data log: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return fmt.Errorf("error compressing data log: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error compressing data log: %w", err)
+	}
+	return os.Remove(path)
+}
+
+// Close closes the current file.
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file, l.day = nil, ""
+	return err
+}
+
+// Run writes the snapshots received until ctx is done.
+func (l *Logger) Run(ctx context.Context, snapshots <-chan *poller.Snapshot, logErr func(error, string)) {
+	defer l.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-snapshots:
+			if err := l.Write(s); err != nil {
+				logErr(err, "failed to write data log")
+			}
+		}
+	}
+}
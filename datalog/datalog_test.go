@@ -0,0 +1,105 @@
+package datalog_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/datalog"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+func snapshot(t time.Time, usoc float64) *poller.Snapshot {
+	return &poller.Snapshot{Time: t, Status: &api.Status{Usoc: api.FlexFloat(usoc), SystemStatus: "OnGrid"}}
+}
+
+func TestCSVRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	// a file from before the retention is deleted on start
+	old := filepath.Join(dir, "sonnenbatterie-"+now.AddDate(0, 0, -40).Format("2006-01-02")+".csv")
+	if err := os.WriteFile(old, []byte("time\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := datalog.New(datalog.Options{Dir: dir, Format: datalog.FormatCSV, Retention: 30 * 24 * time.Hour, Gzip: true, Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be deleted, got %v", old, err)
+	}
+
+	yesterday := now.AddDate(0, 0, -1)
+	for _, s := range []*poller.Snapshot{snapshot(yesterday, 50), snapshot(now, 60), {Time: now.Add(time.Second)}} {
+		if err := l.Write(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// yesterday's file was compressed on rotation
+	if _, err := os.Stat(filepath.Join(dir, "sonnenbatterie-"+yesterday.Format("2006-01-02")+".csv.gz")); err != nil {
+		t.Error(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "sonnenbatterie-"+now.Format("2006-01-02")+".csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header and two rows, got %q", lines)
+	}
+	header := strings.Split(lines[0], ",")
+	if !slices.Equal(header, datalog.Columns()) {
+		t.Errorf("unexpected header %v", header)
+	}
+	usoc := slices.Index(header, "status.USOC")
+	if row := strings.Split(lines[1], ","); usoc < 0 || row[usoc] != "60" || row[slices.Index(header, "status.SystemStatus")] != "OnGrid" {
+		t.Errorf("unexpected row %q", lines[1])
+	}
+	// a failed poll leaves the cells empty
+	if row := strings.Split(lines[2], ","); row[usoc] != "" {
+		t.Errorf("unexpected row %q", lines[2])
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	dir := t.TempDir()
+	l, err := datalog.New(datalog.Options{Dir: dir, Format: datalog.FormatNDJSON, Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	if err := l.Write(snapshot(now, 42)); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	f, err := os.Open(filepath.Join(dir, "sonnenbatterie-"+now.Format("2006-01-02")+".ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("expected a line")
+	}
+	var record map[string]any
+	if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["status.USOC"] != 42.0 {
+		t.Errorf("unexpected record %v", record)
+	}
+	if _, ok := record["battery.cyclecount"]; ok {
+		t.Errorf("expected no battery values without battery data, got %v", record)
+	}
+}
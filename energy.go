@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+// energyState holds the energy counters in watt hours.
+type energyState struct {
+	ChargedWh    float64 `json:"charged_wh"`
+	DischargedWh float64 `json:"discharged_wh"`
+	GridImportWh float64 `json:"grid_import_wh"`
+	GridExportWh float64 `json:"grid_export_wh"`
+}
+
+var energyMetrics = metricTable[*energyState]{
+	{"solar_battery_charged_energy_wh_total", "Energy charged into the battery in watt hours", "watt hours", counter, nil, func(e *energyState) []sample { return one(e.ChargedWh) }},
+	{"solar_battery_discharged_energy_wh_total", "Energy discharged from the battery in watt hours", "watt hours", counter, nil, func(e *energyState) []sample { return one(e.DischargedWh) }},
+	{"solar_battery_grid_import_energy_wh_total", "Energy drawn from the grid in watt hours", "watt hours", counter, nil, func(e *energyState) []sample { return one(e.GridImportWh) }},
+	{"solar_battery_grid_export_energy_wh_total", "Energy fed into the grid in watt hours", "watt hours", counter, nil, func(e *energyState) []sample { return one(e.GridExportWh) }},
+}
+
+// powerSample is the battery and grid power of one poll.
+type powerSample struct {
+	time    time.Time
+	battery float64
+	grid    float64
+}
+
+// energyIntegrator integrates the battery and grid power of consecutive
+// polls into energy counters. Polls further apart than maxGap, e.g. while
+// the battery was unreachable, are not integrated.
+type energyIntegrator struct {
+	maxGap time.Duration
+
+	mu    sync.Mutex
+	state energyState
+	last  *powerSample
+}
+
+func newEnergyIntegrator(maxGap time.Duration) *energyIntegrator {
+	return &energyIntegrator{maxGap: maxGap}
+}
+
+// update integrates the power flows of the snapshot since the previous one.
+func (e *energyIntegrator) update(s *poller.Snapshot) {
+	if !s.OK() {
+		return
+	}
+	cur := &powerSample{s.Time, float64(s.Status.PacTotalW), s.Status.GridFeedInW}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	last := e.last
+	e.last = cur
+	if last == nil {
+		return
+	}
+	dt := cur.time.Sub(last.time)
+	if dt <= 0 || dt > e.maxGap {
+		return
+	}
+
+	discharged, charged := integrate(last.battery, cur.battery, dt)
+	e.state.DischargedWh += discharged
+	e.state.ChargedWh += charged
+	exported, imported := integrate(last.grid, cur.grid, dt)
+	e.state.GridExportWh += exported
+	e.state.GridImportWh += imported
+}
+
+// integrate returns the energy in watt hours of the positive and the
+// negative part of a power changing linearly from p0 to p1 over dt, both as
+// positive values. A sign change is split at the zero crossing.
+func integrate(p0, p1 float64, dt time.Duration) (positive, negative float64) {
+	h := dt.Hours()
+	switch {
+	case p0 >= 0 && p1 >= 0:
+		return (p0 + p1) / 2 * h, 0
+	case p0 <= 0 && p1 <= 0:
+		return 0, -(p0 + p1) / 2 * h
+	}
+	// fraction of dt until the power crosses zero
+	f := p0 / (p0 - p1)
+	before := p0 / 2 * f * h
+	after := p1 / 2 * (1 - f) * h
+	if p0 > 0 {
+		return before, -after
+	}
+	return after, -before
+}
+
+// Describe implements Collector.
+func (e *energyIntegrator) Describe(ch chan<- *prometheus.Desc) {
+	energyMetrics.describe(ch)
+}
+
+// Collect implements Collector.
+func (e *energyIntegrator) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	state := e.state
+	e.mu.Unlock()
+	energyMetrics.collect(ch, &state)
+}
+
+func (e *energyIntegrator) marshalState() (json.RawMessage, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return json.Marshal(e.state)
+}
+
+func (e *energyIntegrator) restoreState(data json.RawMessage) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return json.Unmarshal(data, &e.state)
+}
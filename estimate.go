@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+// runtimeEstimate is the estimated time until the battery is empty or full
+// at the smoothed battery power. Only the one matching the current direction
+// is set.
+type runtimeEstimate struct {
+	toEmpty *time.Duration
+	toFull  *time.Duration
+}
+
+var estimateMetrics = metricTable[*runtimeEstimate]{
+	{"solar_battery_time_to_empty_seconds", "Estimated time until the battery is discharged down to the backup buffer at the smoothed discharge power, in seconds", "seconds", gauge, nil, func(e *runtimeEstimate) []sample {
+		if e.toEmpty == nil {
+			return nil
+		}
+		return one(e.toEmpty.Seconds())
+	}},
+	{"solar_battery_time_to_full_seconds", "Estimated time until the battery is fully charged at the smoothed charge power, in seconds", "seconds", gauge, nil, func(e *runtimeEstimate) []sample {
+		if e.toFull == nil {
+			return nil
+		}
+		return one(e.toFull.Seconds())
+	}},
+}
+
+// runtimeEstimator averages the battery power of the polls within window to
+// estimate the time to empty and full, so a kettle boiling for a minute does
+// not halve the estimate.
+type runtimeEstimator struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	power    []powerSample
+	estimate runtimeEstimate
+}
+
+func newRuntimeEstimator(window time.Duration) *runtimeEstimator {
+	return &runtimeEstimator{window: window}
+}
+
+// update adds the battery power of the snapshot and recomputes the estimate
+// from the snapshot's capacities.
+func (r *runtimeEstimator) update(s *poller.Snapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !s.OK() {
+		r.power = nil
+		r.estimate = runtimeEstimate{}
+		return
+	}
+
+	r.power = append(r.power, powerSample{time: s.Time, battery: float64(s.Status.PacTotalW)})
+	for len(r.power) > 1 && s.Time.Sub(r.power[0].time) > r.window {
+		r.power = r.power[1:]
+	}
+	var sum float64
+	for _, p := range r.power {
+		sum += p.battery
+	}
+	power := sum / float64(len(r.power))
+
+	r.estimate = runtimeEstimate{}
+	remaining := float64(s.Status.RemainingCapacityWh)
+	capacity := fullCapacity(s)
+	switch {
+	case power > 0:
+		// the backup buffer is only available during a grid outage
+		var reserve float64
+		if s.Status.SystemStatus != "OffGrid" {
+			if buffer, err := s.Status.BackupBuffer.Float64(); err == nil {
+				reserve = capacity * buffer / 100
+			}
+		}
+		d := hours(max(0, remaining-reserve) / power)
+		r.estimate.toEmpty = &d
+	case power < 0 && capacity > 0:
+		d := hours(max(0, capacity-remaining) / -power)
+		r.estimate.toFull = &d
+	}
+}
+
+// fullCapacity returns the full charge capacity in watt hours, from the
+// latest data if available, else scaled from the remaining capacity and the
+// state of charge.
+func fullCapacity(s *poller.Snapshot) float64 {
+	if s.LatestData != nil && s.LatestData.FullChargeCapacity > 0 {
+		return float64(s.LatestData.FullChargeCapacity)
+	}
+	if s.Status.Rsoc <= 0 {
+		return 0
+	}
+	return float64(s.Status.RemainingCapacityWh) / float64(s.Status.Rsoc) * 100
+}
+
+func hours(h float64) time.Duration {
+	return time.Duration(h * float64(time.Hour))
+}
+
+// Describe implements Collector.
+func (r *runtimeEstimator) Describe(ch chan<- *prometheus.Desc) {
+	estimateMetrics.describe(ch)
+}
+
+// Collect implements Collector.
+func (r *runtimeEstimator) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	estimate := r.estimate
+	r.mu.Unlock()
+	estimateMetrics.collect(ch, &estimate)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+// Event severities.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// lostContactPolls is the number of consecutive failed polls after which the
+// battery is considered unreachable.
+const lostContactPolls = 3
+
+// socLowHysteresis is how far the charge has to rise above the low threshold
+// before another low charge event is sent.
+const socLowHysteresis = 5
+
+// event is a state transition of the battery.
+type event struct {
+	Type string `json:"type"`
+	// Subject distinguishes events of the same type, e.g. the alarm bit or
+	// the threshold check
+	Subject  string    `json:"subject,omitempty"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// key identifies events for deduplication.
+func (e event) key() string {
+	return e.Type + "/" + e.Subject
+}
+
+// recoveryEvents are the types telling that a problem cleared.
+var recoveryEvents = map[string]bool{
+	"contact_restored":  true,
+	"on_grid":           true,
+	"discharge_allowed": true,
+	"alarm_cleared":     true,
+	"threshold_cleared": true,
+}
+
+// recovery reports whether the event tells that a problem cleared.
+func (e event) recovery() bool {
+	return recoveryEvents[e.Type]
+}
+
+// eventEngine compares consecutive snapshots and emits an event for each
+// transition. The first snapshot only sets the baseline.
+type eventEngine struct {
+	limits thresholds
+	// usable charge in percent below which socLow is emitted
+	socLow float64
+	emit   func(event)
+
+	last     *poller.Snapshot
+	failures int
+	lost     bool
+	low      bool
+	// alarm bits of the last snapshot with battery data
+	alarm    *uint64
+	exceeded map[string]bool
+}
+
+func newEventEngine(limits thresholds, socLow float64, emit func(event)) *eventEngine {
+	return &eventEngine{limits: limits, socLow: socLow, emit: emit}
+}
+
+// update detects the transitions since the last reachable snapshot.
+func (e *eventEngine) update(s *poller.Snapshot) {
+	send := func(typ, subject, severity, format string, args ...any) {
+		e.emit(event{typ, subject, severity, fmt.Sprintf(format, args...), s.Time})
+	}
+
+	if !s.OK() {
+		e.failures++
+		if e.failures == lostContactPolls && e.last != nil {
+			e.lost = true
+			send("lost_contact", "", severityCritical, "Lost contact to the battery: %s", s.Errors[poller.EndpointStatus])
+		}
+		return
+	}
+	e.failures = 0
+	if e.lost {
+		e.lost = false
+		send("contact_restored", "", severityInfo, "Contact to the battery restored")
+	}
+
+	prev := e.last
+	e.last = s
+	status := s.Status
+	usoc := float64(status.Usoc)
+	if prev == nil {
+		e.low = usoc < e.socLow
+		e.exceeded = e.checkThresholds(s)
+		if s.Battery != nil {
+			alarm := uint64(s.Battery.SystemAlarm)
+			e.alarm = &alarm
+		}
+		return
+	}
+
+	if was, is := prev.Status.SystemStatus, status.SystemStatus; was != is {
+		switch is {
+		case "OffGrid":
+			send("off_grid", "", severityCritical, "Grid outage, the battery switched to off grid operation")
+		case "OnGrid":
+			send("on_grid", "", severityInfo, "Grid restored, the battery is back on grid")
+		default:
+			send("system_status", "", severityWarning, "System status changed from %s to %s", was, is)
+		}
+	}
+	if was, is := prev.Status.OperatingMode, status.OperatingMode; was != is {
+		send("mode_changed", "", severityInfo, "Operating mode changed from %s to %s", was, is)
+	}
+	if was, is := prev.Status.DischargeNotAllowed, status.DischargeNotAllowed; was != is {
+		if is {
+			send("discharge_not_allowed", "", severityWarning, "Discharging is not allowed, e.g. due to battery maintenance")
+		} else {
+			send("discharge_allowed", "", severityInfo, "Discharging is allowed again")
+		}
+	}
+	if prev.Status.Usoc < 100 && usoc >= 100 {
+		send("battery_full", "", severityInfo, "Battery is fully charged")
+	}
+	switch {
+	case !e.low && usoc < e.socLow:
+		e.low = true
+		send("soc_low", "", severityWarning, "Usable charge dropped to %.0f%%", usoc)
+	case e.low && usoc >= e.socLow+socLowHysteresis:
+		e.low = false
+	}
+
+	if s.Battery != nil {
+		is := uint64(s.Battery.SystemAlarm)
+		was := is
+		if e.alarm != nil {
+			was = *e.alarm
+		}
+		e.alarm = &is
+		for changed := was ^ is; changed != 0; changed &= changed - 1 {
+			bit := bits.TrailingZeros64(changed)
+			if is&(1<<bit) != 0 {
+				send("alarm_set", fmt.Sprint(bit), severityCritical, "Battery alarm bit %d set", bit)
+			} else {
+				send("alarm_cleared", fmt.Sprint(bit), severityInfo, "Battery alarm bit %d cleared", bit)
+			}
+		}
+	}
+
+	if s.Battery != nil {
+		exceeded := e.checkThresholds(s)
+		for _, c := range thresholdChecks {
+			switch was, is := e.exceeded[c.name], exceeded[c.name]; {
+			case is && !was:
+				send("threshold_exceeded", c.name, severityWarning, "Check %s exceeded its limit %g: %g", c.name, c.limit(e.limits), c.value(s.Battery))
+			case was && !is:
+				send("threshold_cleared", c.name, severityInfo, "Check %s is back within its limit %g: %g", c.name, c.limit(e.limits), c.value(s.Battery))
+			}
+		}
+		e.exceeded = exceeded
+	}
+}
+
+func (e *eventEngine) checkThresholds(s *poller.Snapshot) map[string]bool {
+	exceeded := map[string]bool{}
+	if s.Battery != nil {
+		for _, name := range e.limits.exceeded(s.Battery) {
+			exceeded[name] = true
+		}
+	}
+	return exceeded
+}
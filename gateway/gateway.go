@@ -0,0 +1,153 @@
+// Package gateway serves the last polled battery data as JSON, so other tools
+// on the network can read it without holding the battery's token.
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+// Endpoints served by the gateway, in the order of the snapshot.
+var Endpoints = []string{
+	poller.EndpointStatus,
+	poller.EndpointPowerMeter,
+	poller.EndpointLatestData,
+	poller.EndpointBattery,
+}
+
+// Entry is the last document fetched from an endpoint. A failed poll keeps
+// the previous document and records the error.
+type Entry struct {
+	Endpoint string `json:"endpoint"`
+	// Fetched is the time Data was fetched, zero if it never was
+	Fetched    time.Time  `json:"fetched,omitzero"`
+	AgeSeconds float64    `json:"age_seconds,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	ErrorTime  *time.Time `json:"error_time,omitempty"`
+	Data       any        `json:"data,omitempty"`
+}
+
+// PowerMeters is the data of the powermeter endpoint.
+type PowerMeters struct {
+	Production  *api.PowerMeter `json:"production"`
+	Consumption *api.PowerMeter `json:"consumption"`
+}
+
+// Cache keeps the last document of every endpoint.
+type Cache struct {
+	mu      sync.Mutex
+	polled  time.Time
+	entries map[string]*Entry
+}
+
+// NewCache subscribes to the poller.
+func NewCache(p *poller.Poller) *Cache {
+	c := &Cache{entries: map[string]*Entry{}}
+	p.Subscribe(c.update)
+	return c
+}
+
+func (c *Cache) update(s *poller.Snapshot) {
+	docs := map[string]any{}
+	if s.Status != nil {
+		docs[poller.EndpointStatus] = s.Status
+	}
+	if s.Production != nil {
+		docs[poller.EndpointPowerMeter] = &PowerMeters{s.Production, s.Consumption}
+	}
+	if s.LatestData != nil {
+		docs[poller.EndpointLatestData] = s.LatestData
+	}
+	if s.Battery != nil {
+		docs[poller.EndpointBattery] = s.Battery
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.polled = s.Time
+	for _, endpoint := range Endpoints {
+		entry, ok := c.entries[endpoint]
+		if !ok {
+			entry = &Entry{Endpoint: endpoint}
+		}
+		if msg, failed := s.Errors[endpoint]; failed {
+			errorTime := s.Time
+			entry.Error, entry.ErrorTime = msg, &errorTime
+		} else if doc, fetched := docs[endpoint]; fetched {
+			entry.Data, entry.Fetched = doc, s.Fetched[endpoint]
+			entry.Error, entry.ErrorTime = "", nil
+		} else {
+			// not polled, e.g. disabled or without token
+			continue
+		}
+		c.entries[endpoint] = entry
+	}
+}
+
+// entry returns a copy of the endpoint's entry with its age.
+func (c *Cache) entry(endpoint string, now time.Time) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[endpoint]
+	if !ok {
+		return Entry{}, false
+	}
+	entry := *e
+	if !entry.Fetched.IsZero() {
+		entry.AgeSeconds = now.Sub(entry.Fetched).Seconds()
+	}
+	return entry, true
+}
+
+// Register mounts /api/snapshot and /api/<endpoint> for every endpoint.
+func (c *Cache) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/snapshot", c.serveSnapshot)
+	for _, endpoint := range Endpoints {
+		mux.HandleFunc("GET /api/"+endpoint, func(w http.ResponseWriter, r *http.Request) {
+			c.serveEndpoint(w, endpoint)
+		})
+	}
+}
+
+func (c *Cache) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	resp := struct {
+		Polled    time.Time `json:"polled,omitzero"`
+		Endpoints []Entry   `json:"endpoints"`
+	}{Endpoints: []Entry{}}
+	c.mu.Lock()
+	resp.Polled = c.polled
+	c.mu.Unlock()
+	for _, endpoint := range Endpoints {
+		if entry, ok := c.entry(endpoint, now); ok {
+			resp.Endpoints = append(resp.Endpoints, entry)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// serveEndpoint answers 404 for endpoints that are not polled and 503 until
+// the endpoint was fetched once.
+func (c *Cache) serveEndpoint(w http.ResponseWriter, endpoint string) {
+	entry, ok := c.entry(endpoint, time.Now())
+	switch {
+	case !ok:
+		writeJSON(w, http.StatusNotFound, Entry{Endpoint: endpoint, Error: "endpoint not polled"})
+	case entry.Data == nil:
+		writeJSON(w, http.StatusServiceUnavailable, entry)
+	default:
+		writeJSON(w, http.StatusOK, entry)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
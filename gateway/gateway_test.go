@@ -0,0 +1,68 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/api/apitest"
+	"github.com/joconcepts/sonnenbatterie-exporter/gateway"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+func TestGateway(t *testing.T) {
+	battery := apitest.NewServer()
+	t.Cleanup(battery.Close)
+	battery.SetToken("token")
+	a, err := api.NewSonnenbatterie(battery.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := poller.New(a, time.Minute, time.Second, []string{poller.EndpointBattery})
+	mux := http.NewServeMux()
+	gateway.NewCache(p).Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	get := func(path string, code int) gateway.Entry {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("expected %d for %s, got %s", code, path, resp.Status)
+		}
+		var entry gateway.Entry
+		if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	// nothing polled yet
+	get("/api/status", http.StatusNotFound)
+
+	ctx := context.Background()
+	p.Poll(ctx)
+	status := get("/api/status", http.StatusOK)
+	if data, ok := status.Data.(map[string]any); !ok || data["RSOC"] != 7.0 || status.Fetched.IsZero() {
+		t.Errorf("unexpected status entry %+v", status)
+	}
+
+	// a failed poll keeps the last data and reports the error
+	battery.SetError(apitest.EndpointBattery, http.StatusInternalServerError)
+	p.Poll(ctx)
+	entry := get("/api/battery", http.StatusOK)
+	if entry.Data == nil || entry.Error == "" || entry.ErrorTime == nil {
+		t.Errorf("expected cached data with error, got %+v", entry)
+	}
+
+	// disabled endpoints are not served
+	get("/api/latestdata", http.StatusNotFound)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+const (
+	// full charges reported within this interval of the last recorded one
+	// are the same full charge
+	fullChargeTolerance = time.Hour
+	// maxCapacityRecords bounds the history, about 13 years of daily full
+	// charges
+	maxCapacityRecords = 5000
+)
+
+// capacityRecord is the full charge capacity at one full charge.
+type capacityRecord struct {
+	Time                 time.Time `json:"time"`
+	CycleCount           float64   `json:"cycle_count"`
+	FullChargeCapacityWh int       `json:"full_charge_capacity_wh"`
+}
+
+// healthDoc is the current full charge capacity compared to the nominal one.
+type healthDoc struct {
+	nominalWh  float64
+	capacityWh int
+}
+
+var healthMetrics = metricTable[*healthDoc]{
+	{"solar_battery_nominal_capacity_wh", "Configured nominal capacity of the battery in watt hours", "watt hours", gauge, nil, func(h *healthDoc) []sample {
+		if h.nominalWh <= 0 {
+			return nil
+		}
+		return one(h.nominalWh)
+	}},
+	{"solar_battery_state_of_health_ratio", "Full charge capacity relative to the nominal capacity", "ratio", gauge, nil, func(h *healthDoc) []sample {
+		if h.nominalWh <= 0 || h.capacityWh <= 0 {
+			return nil
+		}
+		return one(float64(h.capacityWh) / h.nominalWh)
+	}},
+}
+
+// healthTracker records the full charge capacity and cycle count at every
+// full charge to document the battery's degradation.
+type healthTracker struct {
+	nominalWh float64
+
+	mu         sync.Mutex
+	capacityWh int
+	cycles     float64
+	history    []capacityRecord
+	// started is the time of the first poll. Without a persisted history
+	// only full charges after it are recorded, the capacity reported for an
+	// older one is not the capacity at that full charge.
+	started time.Time
+}
+
+func newHealthTracker(nominalWh float64) *healthTracker {
+	return &healthTracker{nominalWh: nominalWh}
+}
+
+// update records the snapshot's full charge capacity if the battery was
+// fully charged since the last record, or since startup without one.
+func (h *healthTracker) update(s *poller.Snapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.started.IsZero() {
+		h.started = s.Time
+	}
+	if s.Battery != nil {
+		h.cycles = s.Battery.CycleCount
+	}
+	if s.LatestData == nil || s.LatestData.FullChargeCapacity <= 0 {
+		return
+	}
+	h.capacityWh = s.LatestData.FullChargeCapacity
+
+	charged := s.Time.Add(-time.Duration(s.LatestData.IcStatus.SecondsSinceFullCharge) * time.Second).Truncate(time.Second)
+	if n := len(h.history); n > 0 && charged.Sub(h.history[n-1].Time) < fullChargeTolerance {
+		return
+	}
+	if len(h.history) == 0 && charged.Before(h.started) {
+		return
+	}
+	h.history = append(h.history, capacityRecord{
+		Time:                 charged.UTC(),
+		CycleCount:           h.cycles,
+		FullChargeCapacityWh: h.capacityWh,
+	})
+	if len(h.history) > maxCapacityRecords {
+		h.history = h.history[len(h.history)-maxCapacityRecords:]
+	}
+}
+
+// Describe implements Collector.
+func (h *healthTracker) Describe(ch chan<- *prometheus.Desc) {
+	healthMetrics.describe(ch)
+}
+
+// Collect implements Collector.
+func (h *healthTracker) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	doc := healthDoc{h.nominalWh, h.capacityWh}
+	h.mu.Unlock()
+	healthMetrics.collect(ch, &doc)
+}
+
+// ServeHTTP serves the capacity history as JSON, or as CSV with
+// ?format=csv.
+func (h *healthTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	history := append([]capacityRecord(nil), h.history...)
+	h.mu.Unlock()
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"time", "cycle_count", "full_charge_capacity_wh", "state_of_health"})
+		for _, rec := range history {
+			soh := ""
+			if h.nominalWh > 0 {
+				soh = strconv.FormatFloat(float64(rec.FullChargeCapacityWh)/h.nominalWh, 'f', 4, 64)
+			}
+			_ = cw.Write([]string{
+				rec.Time.Format(time.RFC3339),
+				strconv.FormatFloat(rec.CycleCount, 'f', -1, 64),
+				strconv.Itoa(rec.FullChargeCapacityWh),
+				soh,
+			})
+		}
+		cw.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		NominalCapacityWh float64          `json:"nominal_capacity_wh,omitempty"`
+		History           []capacityRecord `json:"history"`
+	}{h.nominalWh, history})
+}
+
+func (h *healthTracker) marshalState() (json.RawMessage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return json.Marshal(h.history)
+}
+
+func (h *healthTracker) restoreState(data json.RawMessage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return json.Unmarshal(data, &h.history)
+}
@@ -0,0 +1,92 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// maxPoints bounds the number of points of a query, larger ranges need a
+// larger step.
+const maxPoints = 11000
+
+type response struct {
+	Metric string       `json:"metric"`
+	From   time.Time    `json:"from"`
+	To     time.Time    `json:"to"`
+	Step   float64      `json:"step,omitempty"`
+	Points [][2]float64 `json:"points"`
+}
+
+// ServeHTTP answers /api/history?metric=…&from=…&to=…&step=… with the
+// points as [unix seconds, value] pairs. from and to are RFC 3339 or unix
+// seconds and default to the last 24 hours, step is a duration like 5m.
+// Without a metric the stored metrics are listed.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		writeJSON(w, map[string][]string{"metrics": Metrics()})
+		return
+	}
+	if !slices.Contains(Metrics(), metric) {
+		http.Error(w, fmt.Sprintf("unknown metric %q", metric), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	from, err := parseTime(q.Get("from"), now.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTime(q.Get("to"), now)
+	if err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if v := q.Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil || step < 0 {
+			http.Error(w, "invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+	if !to.After(from) {
+		http.Error(w, "to must be after from", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from)/s.spacing(from, step) > maxPoints {
+		http.Error(w, "too many points, increase the step", http.StatusBadRequest)
+		return
+	}
+
+	points, err := s.Query(r.Context(), metric, from, to, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := response{Metric: metric, From: from.UTC(), To: to.UTC(), Step: step.Seconds(), Points: make([][2]float64, len(points))}
+	for i, p := range points {
+		resp.Points[i] = [2]float64{float64(p.Time.Unix()), p.Value}
+	}
+	writeJSON(w, resp)
+}
+
+func parseTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,215 @@
+// Package history stores polled snapshots in a local SQLite database, so
+// small installations get history without running Prometheus.
+//
+// Samples are kept at full resolution for the raw retention and as 5 minute
+// averages for the retention.
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+// Resolution of the downsampled samples.
+const Resolution = 5 * time.Minute
+
+const schema = `
+CREATE TABLE IF NOT EXISTS samples (
+	metric TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	value REAL NOT NULL,
+	PRIMARY KEY (metric, ts)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS samples_5m (
+	metric TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	value REAL NOT NULL,
+	PRIMARY KEY (metric, ts)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS meta (
+	key TEXT PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+`
+
+// Store is a SQLite history database.
+type Store struct {
+	db           *sql.DB
+	interval     time.Duration
+	rawRetention time.Duration
+	retention    time.Duration
+}
+
+// Open opens or creates the database at path for samples stored every
+// interval.
+func Open(path string, interval, rawRetention, retention time.Duration) (*Store, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening history database: %w", err)
+	}
+	// a single connection serializes the writes
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating history database: %w", err)
+	}
+	return &Store{db: db, interval: interval, rawRetention: rawRetention, retention: retention}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Insert stores the values sampled at t.
+func (s *Store) Insert(ctx context.Context, t time.Time, values map[string]float64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR REPLACE INTO samples (metric, ts, value) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for metric, value := range values {
+		if _, err := stmt.ExecContext(ctx, metric, t.Unix(), value); err != nil {
+			return fmt.Errorf("error inserting %s: %w", metric, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Maintain averages the raw samples of all complete 5 minute buckets not yet
+// downsampled and deletes samples past their retention.
+func (s *Store) Maintain(ctx context.Context, now time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var done int64
+	err = tx.QueryRowContext(ctx, `SELECT value FROM meta WHERE key = 'downsampled'`).Scan(&done)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	step := int64(Resolution.Seconds())
+	until := now.Unix() / step * step
+	if until > done {
+		_, err = tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO samples_5m (metric, ts, value)
+			SELECT metric, ts / ?1 * ?1, avg(value) FROM samples
+			WHERE ts >= ?2 AND ts < ?3
+			GROUP BY metric, ts / ?1`, step, done, until)
+		if err != nil {
+			return fmt.Errorf("error downsampling history: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO meta (key, value) VALUES ('downsampled', ?)`, until)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM samples WHERE ts < ?`, now.Add(-s.rawRetention).Unix()); err != nil {
+		return fmt.Errorf("error pruning history: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM samples_5m WHERE ts < ?`, now.Add(-s.retention).Unix()); err != nil {
+		return fmt.Errorf("error pruning history: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Point is one value of a series.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// downsampled are the 5 minute averages, completed by the averages of the
+// raw samples not downsampled yet.
+var downsampled = fmt.Sprintf(`(
+	SELECT metric, ts, value FROM samples_5m
+	UNION ALL
+	SELECT metric, ts / %[1]d * %[1]d, avg(value) FROM samples
+	WHERE ts >= coalesce((SELECT value FROM meta WHERE key = 'downsampled'), 0)
+	GROUP BY metric, ts / %[1]d
+)`, int64(Resolution.Seconds()))
+
+// Query returns the samples of metric between from and to, averaged over
+// step if it is not zero. Ranges reaching back beyond the raw retention are
+// answered from the downsampled samples.
+func (s *Store) Query(ctx context.Context, metric string, from, to time.Time, step time.Duration) ([]Point, error) {
+	table, step := s.source(from, step)
+	bucket := max(int64(step.Seconds()), 1)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT ts / ?1 * ?1 AS bucket, avg(value) FROM `+table+`
+		WHERE metric = ?2 AND ts >= ?3 AND ts <= ?4
+		GROUP BY bucket ORDER BY bucket`, bucket, metric, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("error querying history: %w", err)
+	}
+	defer rows.Close()
+
+	points := []Point{}
+	for rows.Next() {
+		var ts int64
+		var p Point
+		if err := rows.Scan(&ts, &p.Value); err != nil {
+			return nil, err
+		}
+		p.Time = time.Unix(ts, 0).UTC()
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// source returns the table or subquery answering a query from from and the
+// step it is averaged over.
+func (s *Store) source(from time.Time, step time.Duration) (string, time.Duration) {
+	if from.Before(time.Now().Add(-s.rawRetention)) {
+		return downsampled, max(step, Resolution)
+	}
+	return "samples", step
+}
+
+// spacing returns the time between the points of a query from from, the
+// step or the interval of the samples queried.
+func (s *Store) spacing(from time.Time, step time.Duration) time.Duration {
+	_, step = s.source(from, step)
+	if step == 0 {
+		step = s.interval
+	}
+	return max(step, time.Second)
+}
+
+// Run stores the snapshots received until ctx is done and maintains the
+// database every Resolution.
+func (s *Store) Run(ctx context.Context, snapshots <-chan *poller.Snapshot, logErr func(error, string)) {
+	ticker := time.NewTicker(Resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case snapshot := <-snapshots:
+			if values := Values(snapshot); len(values) > 0 {
+				if err := s.Insert(ctx, snapshot.Time, values); err != nil {
+					logErr(err, "failed to store snapshot")
+				}
+			}
+		case now := <-ticker.C:
+			if err := s.Maintain(ctx, now); err != nil {
+				logErr(err, "failed to maintain history")
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package history_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/history"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"), time.Minute, 7*24*time.Hour, 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	insert := func(start time.Time) {
+		t.Helper()
+		// every minute, the charge rising by one percent per minute
+		for i := range 20 {
+			snapshot := &poller.Snapshot{Time: start.Add(time.Duration(i) * time.Minute), Status: &api.Status{Usoc: api.FlexFloat(i)}}
+			if err := store.Insert(ctx, snapshot.Time, history.Values(snapshot)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	now := time.Now().Truncate(time.Hour)
+	recent := now.Add(-2 * time.Hour)
+	insert(recent)
+	points, err := store.Query(ctx, "usable_charge_percent", recent, recent.Add(time.Hour), 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[0].Value != 4.5 || points[1].Value != 14.5 {
+		t.Errorf("unexpected raw points %+v", points)
+	}
+
+	// beyond the raw retention only the 5 minute averages remain
+	start := now.Add(-10 * 24 * time.Hour)
+	insert(start)
+	if err := store.Maintain(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(store)
+	t.Cleanup(srv.Close)
+	from := start.Add(-time.Minute).Format(time.RFC3339)
+	resp, err := http.Get(srv.URL + "/api/history?metric=usable_charge_percent&from=" + from + "&to=" + start.Add(time.Hour).Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Points [][2]float64 `json:"points"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][2]float64{
+		{float64(start.Unix()), 2},
+		{float64(start.Add(5 * time.Minute).Unix()), 7},
+		{float64(start.Add(10 * time.Minute).Unix()), 12},
+		{float64(start.Add(15 * time.Minute).Unix()), 17},
+	}
+	if len(body.Points) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, body.Points)
+	}
+	for i := range expected {
+		if body.Points[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, body.Points)
+			break
+		}
+	}
+}
+
+func TestTooManyPoints(t *testing.T) {
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"), time.Minute, 7*24*time.Hour, 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	srv := httptest.NewServer(store)
+	t.Cleanup(srv.Close)
+
+	now := time.Now().Truncate(time.Second)
+	for _, tc := range []struct {
+		name     string
+		from, to time.Time
+		step     string
+		status   int
+	}{
+		// raw samples are a minute apart
+		{"raw", now.Add(-time.Hour), now.Add(180 * 24 * time.Hour), "", http.StatusBadRequest},
+		{"raw with step", now.Add(-time.Hour), now.Add(180 * 24 * time.Hour), "1h", http.StatusOK},
+		// downsampled samples are 5 minutes apart
+		{"downsampled", now.Add(-30 * 24 * time.Hour), now, "", http.StatusOK},
+		{"downsampled too long", now.Add(-30 * 24 * time.Hour), now.Add(10 * 24 * time.Hour), "", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(srv.URL + "/api/history?metric=usable_charge_percent&from=" + tc.from.Format(time.RFC3339) + "&to=" + tc.to.Format(time.RFC3339) + "&step=" + tc.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestQueryAcrossDownsampling(t *testing.T) {
+	ctx := context.Background()
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"), time.Minute, 7*24*time.Hour, 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	insert := func(at time.Time, usoc float64) {
+		t.Helper()
+		snapshot := &poller.Snapshot{Time: at, Status: &api.Status{Usoc: api.FlexFloat(usoc)}}
+		if err := store.Insert(ctx, at, history.Values(snapshot)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now().Truncate(time.Hour).Add(-10 * 24 * time.Hour)
+	insert(start, 10)
+	insert(start.Add(time.Minute), 20)
+	if err := store.Maintain(ctx, start.Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// not downsampled yet
+	insert(start.Add(10*time.Minute), 30)
+	insert(start.Add(11*time.Minute), 50)
+
+	points, err := store.Query(ctx, "usable_charge_percent", start, start.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []history.Point{{Time: start.UTC(), Value: 15}, {Time: start.Add(10 * time.Minute).UTC(), Value: 40}}
+	if len(points) != len(expected) || points[0] != expected[0] || points[1] != expected[1] {
+		t.Errorf("expected %v, got %v", expected, points)
+	}
+}
@@ -0,0 +1,85 @@
+package history
+
+import (
+	"sort"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+// series are the values stored per snapshot, named after the exporter's
+// metrics without the solar_battery_ prefix.
+var series = []struct {
+	name  string
+	value func(*poller.Snapshot) (float64, bool)
+}{
+	{"charge_percent", fromStatus(func(s *api.Status) float64 { return float64(s.Rsoc) })},
+	{"usable_charge_percent", fromStatus(func(s *api.Status) float64 { return float64(s.Usoc) })},
+	{"remaining_charge_capacity", fromStatus(func(s *api.Status) float64 { return float64(s.RemainingCapacityWh) })},
+	{"production_power", fromStatus(func(s *api.Status) float64 { return float64(s.ProductionW) })},
+	{"consumption_power", fromStatus(func(s *api.Status) float64 { return float64(s.ConsumptionW) })},
+	{"pac_total", fromStatus(func(s *api.Status) float64 { return float64(s.PacTotalW) })},
+	{"grid_feed_in_power", fromStatus(func(s *api.Status) float64 { return s.GridFeedInW })},
+	{"grid_frequency", fromStatus(func(s *api.Status) float64 { return s.Fac })},
+	{"grid_voltage", fromStatus(func(s *api.Status) float64 { return s.Uac })},
+
+	{"production_energy_total", func(s *poller.Snapshot) (float64, bool) {
+		if s.Production == nil {
+			return 0, false
+		}
+		return s.Production.KwhImported, true
+	}},
+	{"consumption_energy_total", func(s *poller.Snapshot) (float64, bool) {
+		if s.Consumption == nil {
+			return 0, false
+		}
+		return s.Consumption.KwhImported, true
+	}},
+
+	{"cycle_count", fromBattery(func(b *api.BatteryModuleData) float64 { return b.CycleCount })},
+	{"maximum_cell_voltage", fromBattery(func(b *api.BatteryModuleData) float64 { return b.MaximumCellVoltage })},
+	{"minimum_cell_voltage", fromBattery(func(b *api.BatteryModuleData) float64 { return b.MinimumCellVoltage })},
+	{"maximum_cell_temperature", fromBattery(func(b *api.BatteryModuleData) float64 { return b.MaximumCellTemperature })},
+	{"minimum_cell_temperature", fromBattery(func(b *api.BatteryModuleData) float64 { return b.MinimumCellTemperature })},
+	{"system_voltage", fromBattery(func(b *api.BatteryModuleData) float64 { return b.SystemVoltage })},
+	{"system_current", fromBattery(func(b *api.BatteryModuleData) float64 { return b.SystemCurrent })},
+}
+
+func fromStatus(value func(*api.Status) float64) func(*poller.Snapshot) (float64, bool) {
+	return func(s *poller.Snapshot) (float64, bool) {
+		if s.Status == nil {
+			return 0, false
+		}
+		return value(s.Status), true
+	}
+}
+
+func fromBattery(value func(*api.BatteryModuleData) float64) func(*poller.Snapshot) (float64, bool) {
+	return func(s *poller.Snapshot) (float64, bool) {
+		if s.Battery == nil {
+			return 0, false
+		}
+		return value(s.Battery), true
+	}
+}
+
+// Metrics returns the names of the stored series.
+func Metrics() []string {
+	names := make([]string, len(series))
+	for i, s := range series {
+		names[i] = s.name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Values returns the stored values of the snapshot by metric name.
+func Values(s *poller.Snapshot) map[string]float64 {
+	values := map[string]float64{}
+	for _, m := range series {
+		if v, ok := m.value(s); ok {
+			values[m.name] = v
+		}
+	}
+	return values
+}
@@ -0,0 +1,37 @@
+package main
+
+import "math"
+
+// derivedMetrics are energy KPIs computed from the instantaneous power flows
+// of the status document. Ratios are skipped while their denominator is
+// zero, e.g. self consumption at night.
+var derivedMetrics = metricTable[*statusDoc]{
+	{"solar_battery_grid_import_power", "Power drawn from the grid in watts", "watts", gauge, nil, func(s *statusDoc) []sample { return one(gridImport(s)) }},
+	{"solar_battery_grid_export_power", "Power fed into the grid in watts", "watts", gauge, nil, func(s *statusDoc) []sample { return one(gridExport(s)) }},
+	{"solar_battery_self_sufficiency_ratio", "Share of the consumption not drawn from the grid (autarky), 0 to 1", "ratio", gauge, nil, func(s *statusDoc) []sample {
+		return ratio(float64(s.ConsumptionW)-gridImport(s), float64(s.ConsumptionW))
+	}},
+	{"solar_battery_self_consumption_ratio", "Share of the PV production used on site instead of fed into the grid, 0 to 1", "ratio", gauge, nil, func(s *statusDoc) []sample {
+		return ratio(float64(s.ProductionW)-gridExport(s), float64(s.ProductionW))
+	}},
+	{"solar_battery_battery_contribution_ratio", "Share of the consumption covered by discharging the battery, 0 to 1", "ratio", gauge, nil, func(s *statusDoc) []sample {
+		return ratio(math.Max(0, float64(s.PacTotalW)), float64(s.ConsumptionW))
+	}},
+}
+
+func gridImport(s *statusDoc) float64 {
+	return math.Max(0, -s.GridFeedInW)
+}
+
+func gridExport(s *statusDoc) float64 {
+	return math.Max(0, s.GridFeedInW)
+}
+
+// ratio returns part/total clamped to [0, 1], or no sample if total is not
+// positive.
+func ratio(part, total float64) []sample {
+	if total <= 0 {
+		return nil
+	}
+	return one(math.Max(0, math.Min(1, part/total)))
+}
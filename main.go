@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/justinas/alice"
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,376 +22,369 @@ import (
 	"github.com/rs/zerolog/hlog"
 
 	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/control"
+	"github.com/joconcepts/sonnenbatterie-exporter/dashboard"
+	"github.com/joconcepts/sonnenbatterie-exporter/datalog"
+	"github.com/joconcepts/sonnenbatterie-exporter/gateway"
+	"github.com/joconcepts/sonnenbatterie-exporter/history"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+	"github.com/joconcepts/sonnenbatterie-exporter/stream"
 )
 
+//go:generate sh -c "go run . docs > METRICS.md"
+
 const timeout = 15 * time.Second
 
 var log = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).With().
 	Timestamp().
 	Logger()
 
-type collector struct {
-	api *api.Sonnenbatterie
-
-	gridVoltage            *prometheus.Desc
-	gridFrequency          *prometheus.Desc
-	chargePercent          *prometheus.Desc
-	usableChargePercent    *prometheus.Desc
-	consumptionPower       *prometheus.Desc
-	consumptionEnergy      *prometheus.Desc
-	productionPower        *prometheus.Desc
-	productionEnergy       *prometheus.Desc
-	lastFullyCharged       *prometheus.Desc
-	fullChargeCapacity     *prometheus.Desc
-	remaningChargeCapacity *prometheus.Desc
-	pacTotal               *prometheus.Desc
-
-	batteryCycleCount             *prometheus.Desc
-	batteryMaximumCellTemperature *prometheus.Desc
-	batteryMaximumCellVoltage     *prometheus.Desc
-	batteryMaximumModuleCurrent   *prometheus.Desc
-	batteryMaximumModuleDCVoltage *prometheus.Desc
-	batteryMinimumCellTemperature *prometheus.Desc
-	batteryMinimumCellVoltage     *prometheus.Desc
-	batteryMinimumModuleCurrent   *prometheus.Desc
-	batteryMinimumModuleDCVoltage *prometheus.Desc
-	batteryRelativeStateOfCharge  *prometheus.Desc
-	batteryRemainingCapacity      *prometheus.Desc
-	batterySystemAlarm            *prometheus.Desc
-	batterySystemCurrent          *prometheus.Desc
-	batterySystemVoltage          *prometheus.Desc
-	batterySystemDCVoltage        *prometheus.Desc
-	batterySystemStatus           *prometheus.Desc
-	batterySystemWarning          *prometheus.Desc
-}
-
-func newCollector(api *api.Sonnenbatterie) *collector {
-	return &collector{
-		api: api,
-		gridVoltage: prometheus.NewDesc(
-			"solar_battery_grid_voltage",
-			"Solar battery Grid (AC) voltage",
-			[]string{"phase"},
-			nil,
-		),
-		gridFrequency: prometheus.NewDesc(
-			"solar_battery_grid_frequency",
-			"Solar battery Grid (AC) frequency in Hz",
-			nil,
-			nil,
-		),
-		chargePercent: prometheus.NewDesc(
-			"solar_battery_charge_percent",
-			"Solar battery charge in percent",
-			nil,
-			nil,
-		),
-		usableChargePercent: prometheus.NewDesc(
-			"solar_battery_usable_charge_percent",
-			"Solar battery usable charge in percent",
-			nil,
-			nil,
-		),
-		consumptionPower: prometheus.NewDesc(
-			"solar_battery_consumption_power",
-			"Solar battery consumption power in watts",
-			[]string{"phase"},
-			nil,
-		),
-		consumptionEnergy: prometheus.NewDesc(
-			"solar_battery_consumption_energy_total",
-			"Total consumption measured in kwH",
-			nil,
-			nil,
-		),
-		productionPower: prometheus.NewDesc(
-			"solar_battery_production_power",
-			"Solar battery production power in watts",
-			[]string{"phase"},
-			nil,
-		),
-		productionEnergy: prometheus.NewDesc(
-			"solar_battery_production_energy_total",
-			"Total production measured in kwH",
-			nil,
-			nil,
-		),
-		lastFullyCharged: prometheus.NewDesc(
-			"solar_battery_last_fully_charged_unix_timestamp",
-			"Timestamp of last full charge",
-			nil,
-			nil,
-		),
-		fullChargeCapacity: prometheus.NewDesc(
-			"solar_battery_full_charge_capacity",
-			"Full charge capacity in watt hours",
-			nil,
-			nil,
-		),
-		remaningChargeCapacity: prometheus.NewDesc(
-			"solar_battery_remaining_charge_capacity",
-			"Remaining charge capacity in watt hours",
-			nil,
-			nil,
-		),
-		pacTotal: prometheus.NewDesc(
-			"solar_battery_pac_total",
-			"Total AC power of battery, greaater zero is discharging, less than zero is charging",
-			nil,
-			nil,
-		),
-
-		batteryCycleCount: prometheus.NewDesc(
-			"solar_battery_cycle_count",
-			"Cycle count of battery module",
-			nil,
-			nil,
-		),
-		batteryMaximumCellTemperature: prometheus.NewDesc(
-			"solar_battery_maximum_cell_temperature",
-			"Maximum cell temperature of battery",
-			nil,
-			nil,
-		),
-		batteryMaximumCellVoltage: prometheus.NewDesc(
-			"solar_battery_maximum_cell_voltage",
-			"Maximum cell voltage of battery",
-			nil,
-			nil,
-		),
-		batteryMaximumModuleCurrent: prometheus.NewDesc(
-			"solar_battery_maximum_module_current",
-			"Maximum module current of battery",
-			nil,
-			nil,
-		),
-		batteryMaximumModuleDCVoltage: prometheus.NewDesc(
-			"solar_battery_maximum_module_dc_voltage",
-			"Maximum module DC voltage of battery",
-			nil,
-			nil,
-		),
-		batteryMinimumCellTemperature: prometheus.NewDesc(
-			"solar_battery_minimum_cell_temperature",
-			"Minimum cell temperature of battery",
-			nil,
-			nil,
-		),
-		batteryMinimumCellVoltage: prometheus.NewDesc(
-			"solar_battery_minimum_cell_voltage",
-			"Minimum cell voltage of battery",
-			nil,
-			nil,
-		),
-		batteryMinimumModuleCurrent: prometheus.NewDesc(
-			"solar_battery_minimum_module_current",
-			"Minimum module current of battery",
-			nil,
-			nil,
-		),
-		batteryMinimumModuleDCVoltage: prometheus.NewDesc(
-			"solar_battery_minimum_module_dc_voltage",
-			"Minimum module DC voltage of battery",
-			nil,
-			nil,
-		),
-		batteryRelativeStateOfCharge: prometheus.NewDesc(
-			"solar_battery_relative_state_of_charge",
-			"Relative state of charge of battery",
-			nil,
-			nil,
-		),
-		batteryRemainingCapacity: prometheus.NewDesc(
-			"solar_battery_remaining_capacity",
-			"Remaining capacity of battery",
-			nil,
-			nil,
-		),
-		batterySystemAlarm: prometheus.NewDesc(
-			"solar_battery_system_alarm",
-			"System alarm status of battery",
-			nil,
-			nil,
-		),
-		batterySystemCurrent: prometheus.NewDesc(
-			"solar_battery_system_current",
-			"System current of battery",
-			nil,
-			nil,
-		),
-		batterySystemVoltage: prometheus.NewDesc(
-			"solar_battery_system_voltage",
-			"System voltage of battery",
-			nil,
-			nil,
-		),
-		batterySystemDCVoltage: prometheus.NewDesc(
-			"solar_battery_system_dc_voltage",
-			"System DC voltage of battery",
-			nil,
-			nil,
-		),
-		batterySystemStatus: prometheus.NewDesc(
-			"solar_battery_system_status",
-			"System status of battery",
-			nil,
-			nil,
-		),
-		batterySystemWarning: prometheus.NewDesc(
-			"solar_battery_system_warning",
-			"System warning status of battery",
-			nil,
-			nil,
-		),
-	}
-}
-
-// Describe implements Collector.
-func (c *collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.gridVoltage
-	ch <- c.gridFrequency
-	ch <- c.chargePercent
-	ch <- c.usableChargePercent
-	ch <- c.consumptionPower
-	ch <- c.consumptionEnergy
-	ch <- c.productionPower
-	ch <- c.productionEnergy
-}
-
-func (c *collector) collectStatus(ch chan<- prometheus.Metric) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	status, err := c.api.GetStatus(ctx)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to get status")
-		return
-	}
-
-	ch <- prometheus.MustNewConstMetric(c.gridVoltage, prometheus.GaugeValue, status.Uac, "")
-	ch <- prometheus.MustNewConstMetric(c.gridFrequency, prometheus.GaugeValue, status.Fac)
-	ch <- prometheus.MustNewConstMetric(c.chargePercent, prometheus.GaugeValue, float64(status.Rsoc))
-	ch <- prometheus.MustNewConstMetric(c.usableChargePercent, prometheus.GaugeValue, float64(status.Usoc))
-	ch <- prometheus.MustNewConstMetric(c.consumptionPower, prometheus.GaugeValue, float64(status.ConsumptionW), "")
-	ch <- prometheus.MustNewConstMetric(c.productionPower, prometheus.GaugeValue, float64(status.ProductionW), "")
-	ch <- prometheus.MustNewConstMetric(c.remaningChargeCapacity, prometheus.GaugeValue, float64(status.RemainingCapacityWh))
-	ch <- prometheus.MustNewConstMetric(c.pacTotal, prometheus.GaugeValue, float64(status.PacTotalW))
-}
-
-func (c *collector) collectPowerMeter(ch chan<- prometheus.Metric) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	production, consumption, err := c.api.GetPowerMeter(ctx)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to get power meter")
-		return
-	}
-
-	ch <- prometheus.MustNewConstMetric(c.gridVoltage, prometheus.GaugeValue, consumption.VL1N, "L1")
-	ch <- prometheus.MustNewConstMetric(c.gridVoltage, prometheus.GaugeValue, consumption.VL2N, "L2")
-	ch <- prometheus.MustNewConstMetric(c.gridVoltage, prometheus.GaugeValue, consumption.VL3N, "L3")
-	ch <- prometheus.MustNewConstMetric(c.gridVoltage, prometheus.GaugeValue, consumption.VL1L2, "L1-L2")
-	ch <- prometheus.MustNewConstMetric(c.gridVoltage, prometheus.GaugeValue, consumption.VL2L3, "L2-L3")
-	ch <- prometheus.MustNewConstMetric(c.gridVoltage, prometheus.GaugeValue, consumption.VL3L1, "L3-L1")
-
-	ch <- prometheus.MustNewConstMetric(c.consumptionPower, prometheus.GaugeValue, consumption.WL1, "L1")
-	ch <- prometheus.MustNewConstMetric(c.consumptionPower, prometheus.GaugeValue, consumption.WL2, "L2")
-	ch <- prometheus.MustNewConstMetric(c.consumptionPower, prometheus.GaugeValue, consumption.WL3, "L3")
-	ch <- prometheus.MustNewConstMetric(c.consumptionEnergy, prometheus.CounterValue, consumption.KwhImported)
-
-	ch <- prometheus.MustNewConstMetric(c.productionPower, prometheus.GaugeValue, production.WL1, "L1")
-	ch <- prometheus.MustNewConstMetric(c.productionPower, prometheus.GaugeValue, production.WL2, "L2")
-	ch <- prometheus.MustNewConstMetric(c.productionPower, prometheus.GaugeValue, production.WL3, "L3")
-	ch <- prometheus.MustNewConstMetric(c.productionEnergy, prometheus.CounterValue, production.KwhImported)
-}
-
-func (c *collector) collectLatestData(ch chan<- prometheus.Metric) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	latestData, err := c.api.GetLatestData(ctx)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to get latest data")
-		return
-	}
-
-	ch <- prometheus.MustNewConstMetric(c.lastFullyCharged, prometheus.GaugeValue, (float64(time.Now().UnixNano())/1e9)-float64(latestData.IcStatus.SecondsSinceFullCharge))
-	ch <- prometheus.MustNewConstMetric(c.fullChargeCapacity, prometheus.GaugeValue, float64(latestData.FullChargeCapacity))
-}
-
-func (c *collector) collectBatteryModuleData(ch chan<- prometheus.Metric) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	battery_module, err := c.api.GetBatteryModuleData(ctx)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to get status")
-		return
-	}
-
-	ch <- prometheus.MustNewConstMetric(c.batteryCycleCount, prometheus.GaugeValue, battery_module.CycleCount)
-	ch <- prometheus.MustNewConstMetric(c.batteryMaximumCellTemperature, prometheus.GaugeValue, battery_module.MaximumCellTemperature)
-	ch <- prometheus.MustNewConstMetric(c.batteryMaximumCellVoltage, prometheus.GaugeValue, battery_module.MaximumCellVoltage)
-	ch <- prometheus.MustNewConstMetric(c.batteryMaximumModuleCurrent, prometheus.GaugeValue, battery_module.MaximumModuleCurrent)
-	ch <- prometheus.MustNewConstMetric(c.batteryMaximumModuleDCVoltage, prometheus.GaugeValue, battery_module.MaximumModuleDCVoltage)
-	ch <- prometheus.MustNewConstMetric(c.batteryMinimumCellTemperature, prometheus.GaugeValue, battery_module.MinimumCellTemperature)
-	ch <- prometheus.MustNewConstMetric(c.batteryMinimumCellVoltage, prometheus.GaugeValue, battery_module.MinimumCellVoltage)
-	ch <- prometheus.MustNewConstMetric(c.batteryMinimumModuleCurrent, prometheus.GaugeValue, battery_module.MinimumModuleCurrent)
-	ch <- prometheus.MustNewConstMetric(c.batteryMinimumModuleDCVoltage, prometheus.GaugeValue, battery_module.MinimumModuleDCVoltage)
-	ch <- prometheus.MustNewConstMetric(c.batteryRelativeStateOfCharge, prometheus.GaugeValue, battery_module.RelativeStateOfCharge)
-	ch <- prometheus.MustNewConstMetric(c.batteryRemainingCapacity, prometheus.GaugeValue, battery_module.RemainingCapacity)
-	ch <- prometheus.MustNewConstMetric(c.batterySystemAlarm, prometheus.GaugeValue, battery_module.SystemAlarm)
-	ch <- prometheus.MustNewConstMetric(c.batterySystemCurrent, prometheus.GaugeValue, battery_module.SystemCurrent)
-	ch <- prometheus.MustNewConstMetric(c.batterySystemVoltage, prometheus.GaugeValue, battery_module.SystemVoltage)
-	ch <- prometheus.MustNewConstMetric(c.batterySystemDCVoltage, prometheus.GaugeValue, battery_module.SystemDCVoltage)
-	ch <- prometheus.MustNewConstMetric(c.batterySystemStatus, prometheus.GaugeValue, battery_module.SystemStatus)
-	ch <- prometheus.MustNewConstMetric(c.batterySystemWarning, prometheus.GaugeValue, battery_module.SystemWarning)
-}
-
-func (c *collector) Collect(ch chan<- prometheus.Metric) {
-	c.collectStatus(ch)
-	if c.api.HasToken() {
-		c.collectPowerMeter(ch)
-		c.collectLatestData(ch)
-		c.collectBatteryModuleData(ch)
-	}
-}
-
 func run() error {
 
 	var (
-		addr        string
-		metricsPath string
-		url         string
-		token       string
+		addr         string
+		metricsPath  string
+		url          string
+		token        string
+		tlsOpts      api.TLSOptions
+		recordDir    string
+		replayDir    string
+		replayLoop   bool
+		strict       bool
+		timezone     string
+		apiVersion   string
+		pollInterval time.Duration
+		stateFile    string
+		window       time.Duration
+		nominalWh    float64
+		limits       = defaultThresholds()
+		notifyOpts   notifyOptions
+		historyDB    string
+		datalogOpts  datalog.Options
+		rawRetention time.Duration
+		retention    time.Duration
+		controlOpts  = control.Options{MaxChargeW: 3300, MaxDischargeW: 3300}
+		tokensFile   string
+		auditLog     string
+		schedule     []string
+		sections     = map[string]*bool{}
 	)
 	flag.StringVar(&addr, "listen-address", ":9110", "The address to listen on for HTTP requests.")
 	flag.StringVar(&metricsPath, "metrics-path", "/metrics", "The path to mount the metrics endpoints.")
 	flag.StringVar(&url, "sonnenbatterie-url", "", "URL for the Sonnenbattery storage battery.")
 	flag.StringVar(&token, "sonnenbatterie-token", "", "Token for the Sonnenbattery storage battery API.")
+	flag.StringVar(&apiVersion, "sonnenbatterie-api-version", "auto", "API version of the battery: v1, v2 or auto to probe v2 and fall back to v1.")
+	flag.StringVar(&tlsOpts.CAFile, "sonnenbatterie-ca-file", "", "PEM file with additional CA certificates to trust for HTTPS.")
+	flag.StringVar(&tlsOpts.CertFile, "sonnenbatterie-cert-file", "", "PEM client certificate for mutual TLS.")
+	flag.StringVar(&tlsOpts.KeyFile, "sonnenbatterie-key-file", "", "PEM client key for mutual TLS.")
+	flag.StringVar(&tlsOpts.ServerName, "sonnenbatterie-server-name", "", "Override the server name used to verify the HTTPS certificate.")
+	flag.BoolVar(&tlsOpts.InsecureSkipVerify, "sonnenbatterie-insecure-skip-verify", false, "Skip verification of the HTTPS certificate. Insecure, use only for testing.")
+	flag.StringVar(&recordDir, "record-dir", "", "Directory to record all raw battery API responses to, with the token redacted.")
+	flag.StringVar(&replayDir, "replay-dir", "", "Directory with recorded battery API responses to serve instead of querying a battery.")
+	flag.BoolVar(&replayLoop, "replay-loop", false, "Restart from the beginning once all recordings were replayed.")
+	flag.BoolVar(&strict, "strict-schema", false, "Report unknown and missing fields in battery API responses.")
+	flag.StringVar(&timezone, "site-timezone", "", "IANA time zone the battery's system clock is set to, e.g. Europe/Berlin. Unset, the battery's clock is not used.")
+	flag.DurationVar(&pollInterval, "poll-interval", 10*time.Second, "Interval to poll the battery in the background for energy counters and the live data. Scrapes are answered from the last poll. 0 disables the poller.")
+	flag.StringVar(&stateFile, "state-file", "", "File to persist energy counters, the capacity history and the schedule's manual mode in across restarts.")
+	flag.DurationVar(&window, "estimate-window", 5*time.Minute, "Window to average the battery power over for the time to empty and full estimates.")
+	flag.Float64Var(&nominalWh, "nominal-capacity-wh", 0, "Nominal capacity of the battery system in watt hours to derive the state of health from. One value is enough: an exporter watches one battery, whose full charge capacity is reported for the whole system.")
+	flag.Float64Var(&limits.CellVoltageSpread, "threshold.cell-voltage-spread", limits.CellVoltageSpread, "Maximum difference between the highest and lowest cell voltage in volts.")
+	flag.Float64Var(&limits.CellTemperatureDelta, "threshold.cell-temperature-delta", limits.CellTemperatureDelta, "Maximum difference between the warmest and coldest cell in degrees celsius.")
+	flag.Float64Var(&limits.CellTemperatureMax, "threshold.cell-temperature-max", limits.CellTemperatureMax, "Maximum cell temperature in degrees celsius.")
+	flag.Float64Var(&limits.CellTemperatureMin, "threshold.cell-temperature-min", limits.CellTemperatureMin, "Minimum cell temperature in degrees celsius.")
+	flag.Var((*stringsFlag)(&notifyOpts.Webhooks), "notify.webhook-url", "URL to POST battery events to as JSON. Can be given multiple times.")
+	flag.Var((*stringsFlag)(&notifyOpts.Ntfy), "notify.ntfy-url", "ntfy topic URL to send battery events to, e.g. https://ntfy.sh/my-battery. Can be given multiple times.")
+	flag.DurationVar(&notifyOpts.DedupWindow, "notify.dedup-window", 15*time.Minute, "Drop events of the same type repeated within this window, except recoveries.")
+	flag.IntVar(&notifyOpts.MaxPerHour, "notify.max-per-hour", 30, "Maximum number of notifications per hour, 0 for no limit. Recoveries are not limited.")
+	flag.Float64Var(&notifyOpts.SocLow, "notify.soc-low", 10, "Usable charge in percent below which a soc_low event is sent.")
+	flag.StringVar(&historyDB, "history-db", "", "SQLite database to store the polled values in, served at /api/history.")
+	flag.DurationVar(&rawRetention, "history-raw-retention", 7*24*time.Hour, "How long to keep the polled values at full resolution.")
+	flag.DurationVar(&retention, "history-retention", 365*24*time.Hour, "How long to keep the 5 minute averages of the polled values.")
+	flag.StringVar(&datalogOpts.Dir, "datalog-dir", "", "Directory to append the polled values to as daily files.")
+	flag.StringVar(&datalogOpts.Format, "datalog-format", datalog.FormatCSV, "Format of the daily files: csv or ndjson.")
+	flag.DurationVar(&datalogOpts.Retention, "datalog-retention", 30*24*time.Hour, "Delete daily files older than this, 0 keeps all.")
+	flag.BoolVar(&datalogOpts.Gzip, "datalog-gzip", true, "Compress the daily files of past days.")
+	flag.StringVar(&tokensFile, "control.tokens-file", "", "File with one \"<role> <token>\" pair per line for the control API at /api/control. Roles are setpoint and admin.")
+	flag.IntVar(&controlOpts.MaxChargeW, "control.max-charge-w", controlOpts.MaxChargeW, "Maximum charge setpoint in watts accepted by the control API and the schedule.")
+	flag.IntVar(&controlOpts.MaxDischargeW, "control.max-discharge-w", controlOpts.MaxDischargeW, "Maximum discharge setpoint in watts accepted by the control API and the schedule.")
+	flag.Var((*stringsFlag)(&schedule), "schedule", "Time-of-use window, e.g. \"charge 3kW 02:00-05:00 soc<60\" or \"hold 17:00-20:00 mon-fri\". Can be given multiple times, the first matching window wins.")
+	flag.StringVar(&auditLog, "control.audit-log", "", "File to append a JSON line to for every control API request.")
+	for _, section := range collectorSections {
+		sections[section.name] = flag.Bool("collector."+section.name, section.enabled, section.help)
+	}
 	flag.Parse()
 
+	if replayDir != "" && url == "" {
+		url = "http://replay.invalid"
+	}
 	if url == "" {
 		return fmt.Errorf("no sonnenbatterie-url set")
 	}
+	if pollInterval <= 0 && notifyOpts.enabled() {
+		return fmt.Errorf("notifications require the poller, set a poll-interval")
+	}
+	if pollInterval <= 0 && historyDB != "" {
+		return fmt.Errorf("the history database requires the poller, set a poll-interval")
+	}
+	if pollInterval <= 0 && datalogOpts.Dir != "" {
+		return fmt.Errorf("the data log requires the poller, set a poll-interval")
+	}
 	// Take token from environment if not set
 	if envToken := os.Getenv("SONNENBATTERIE_TOKEN"); token == "" && envToken != "" {
 		token = envToken
 	}
+	if tokensFile != "" && token == "" {
+		return fmt.Errorf("the control API requires a sonnenbatterie-token")
+	}
+	if len(schedule) > 0 && token == "" {
+		return fmt.Errorf("the schedule requires a sonnenbatterie-token")
+	}
 
 	// create sonnenbatterie collector
 	a, err := api.NewSonnenbatterie(url, token)
 	if err != nil {
 		return err
 	}
+	version, err := api.ParseVersion(apiVersion)
+	if err != nil {
+		return err
+	}
+	a.SetVersion(version)
+	if !tlsOpts.IsZero() {
+		if err := a.SetTLS(tlsOpts); err != nil {
+			return err
+		}
+		if tlsOpts.InsecureSkipVerify {
+			log.Warn().Msg("TLS certificate verification of the sonnenbatterie is disabled")
+		}
+	}
+	if replayDir != "" {
+		replay, err := api.NewReplayTransport(replayDir)
+		if err != nil {
+			return err
+		}
+		replay.Loop = replayLoop
+		a.WrapTransport(func(http.RoundTripper) http.RoundTripper { return replay })
+		log.Info().Str("dir", replayDir).Msg("replaying recorded battery responses")
+	}
+	if recordDir != "" {
+		recorder, err := api.NewRecordingTransport(recordDir)
+		if err != nil {
+			return err
+		}
+		defer recorder.Close()
+		recorder.OnError = func(err error) {
+			log.Error().Err(err).Msg("failed to record battery response")
+		}
+		a.WrapTransport(recorder.Wrap)
+		log.Info().Str("dir", recordDir).Msg("recording battery responses")
+	}
+
+	// opened before the shutdown is waited for, so it is closed after the
+	// last control request
+	if tokensFile != "" {
+		controlOpts.Tokens, err = control.LoadTokens(tokensFile)
+		if err != nil {
+			return err
+		}
+		if auditLog != "" {
+			f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+			if err != nil {
+				return fmt.Errorf("error opening control audit log: %w", err)
+			}
+			defer func() {
+				if err := f.Sync(); err != nil {
+					log.Error().Err(err).Msg("failed to sync control audit log")
+				}
+				f.Close()
+			}()
+			controlOpts.AuditLog = f
+			controlOpts.OnAuditError = func(err error) {
+				log.Error().Err(err).Msg("failed to write control audit log")
+			}
+		}
+	}
 
-	coll := newCollector(a)
+	// the battery's clock is only used with a configured zone, the data log
+	// and the schedule fall back to the exporter's zone
+	location := time.Local
+	var deviceZone *time.Location
+	if timezone != "" {
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return fmt.Errorf("invalid site-timezone: %w", err)
+		}
+		deviceZone = location
+	}
+	windows := make([]*scheduleWindow, len(schedule))
+	for i, spec := range schedule {
+		if windows[i], err = parseScheduleWindow(spec, controlOpts.MaxChargeW, controlOpts.MaxDischargeW); err != nil {
+			return err
+		}
+	}
+
+	coll := newCollector(a, deviceZone)
+	coll.limits = limits
+	for _, section := range collectorSections {
+		enabled := *sections[section.name]
+		coll.enabled[section.name] = enabled
+		log.Info().Str("collector", section.name).Bool("enabled", enabled).Msg("")
+	}
 
 	reg := prometheus.NewRegistry()
-	if err := reg.Register(coll); err != nil {
+
+	// all changes to the client are made before the poller starts
+	if strict {
+		schema := newSchemaTracker()
+		a.SchemaCheck = schema.report
+		if err := reg.Register(schema); err != nil {
+			return err
+		}
+	}
+
+	// saved a last time after the background tasks have stopped, e.g. once
+	// the schedule returned the battery to self consumption
+	state, err := newStateStore(stateFile)
+	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := state.save(); err != nil {
+			log.Error().Err(err).Msg("failed to save state")
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	mux := http.NewServeMux()
+	dashboardOpts := dashboard.Options{MetricsPath: metricsPath}
+	if pollInterval > 0 {
+		// the gateway and the stream serve every document, so the poller
+		// fetches all endpoints regardless of the sections exported at
+		// /metrics
+		p := poller.New(a, pollInterval, timeout, poller.Endpoints)
+		coll.snapshot = p.Last
+
+		energy := newEnergyIntegrator(5 * pollInterval)
+		if err := state.register("energy", energy); err != nil {
+			return err
+		}
+		p.Subscribe(energy.update)
+		if err := reg.Register(energy); err != nil {
+			return err
+		}
+
+		estimator := newRuntimeEstimator(window)
+		p.Subscribe(estimator.update)
+		if err := reg.Register(estimator); err != nil {
+			return err
+		}
+
+		health := newHealthTracker(nominalWh)
+		if err := state.register("health", health); err != nil {
+			return err
+		}
+		p.Subscribe(health.update)
+		if err := reg.Register(health); err != nil {
+			return err
+		}
+		mux.Handle("GET /api/capacity-history", health)
+		hub := stream.NewHub(p)
+		mux.Handle("GET /api/stream", hub)
+		if err := reg.Register(streamCollector{hub}); err != nil {
+			return err
+		}
+		gateway.NewCache(p).Register(mux)
+		dashboardOpts.StreamPath = "/api/stream"
+
+		if notifyOpts.enabled() {
+			notifier := newNotifier(notifyOpts)
+			if err := reg.Register(notifier); err != nil {
+				return err
+			}
+			p.Subscribe(newEventEngine(limits, notifyOpts.SocLow, notifier.notify).update)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				notifier.run(ctx)
+			}()
+			log.Info().Int("webhooks", len(notifyOpts.Webhooks)).Int("ntfy", len(notifyOpts.Ntfy)).Msg("sending battery event notifications")
+		}
+
+		if historyDB != "" {
+			store, err := history.Open(historyDB, pollInterval, rawRetention, retention)
+			if err != nil {
+				return err
+			}
+			snapshots := p.Channel(16, func() {
+				log.Warn().Msg("history database too slow, dropping snapshot")
+			})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer store.Close()
+				store.Run(ctx, snapshots, func(err error, msg string) {
+					log.Error().Err(err).Msg(msg)
+				})
+			}()
+			mux.Handle("GET /api/history", store)
+			log.Info().Str("db", historyDB).Msg("storing history")
+		}
+
+		if datalogOpts.Dir != "" {
+			datalogOpts.Location = location
+			logger, err := datalog.New(datalogOpts)
+			if err != nil {
+				return err
+			}
+			snapshots := p.Channel(16, func() {
+				log.Warn().Msg("data log too slow, dropping snapshot")
+			})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				logger.Run(ctx, snapshots, func(err error, msg string) {
+					log.Error().Err(err).Msg(msg)
+				})
+			}()
+			log.Info().Str("dir", datalogOpts.Dir).Str("format", datalogOpts.Format).Msg("logging polled values")
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Run(ctx)
+		}()
+		log.Info().Dur("interval", pollInterval).Msg("polling battery in the background")
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		state.run(ctx)
+	}()
+
+	if tokensFile != "" {
+		control.New(a, controlOpts).Register(mux)
+		log.Info().Int("tokens", len(controlOpts.Tokens)).Msg("serving control API")
+	}
+
+	if len(windows) > 0 {
+		sched := newScheduler(a, windows, location)
+		if err := state.register("schedule", sched); err != nil {
+			return err
+		}
+		if err := reg.Register(sched); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sched.run(ctx)
+		}()
+		log.Info().Int("windows", len(windows)).Msg("running time-of-use schedule")
+	}
 
 	// go module build info.
 	if err := reg.Register(collectors.NewBuildInfoCollector()); err != nil {
@@ -400,39 +399,63 @@ func run() error {
 	c = c.Append(hlog.NewHandler(log))
 
 	// Expose the registered metrics via HTTP.
-	mux := http.NewServeMux()
-	mux.Handle(metricsPath, promhttp.HandlerFor(
-		reg,
-		promhttp.HandlerOpts{
+	mux.Handle(metricsPath, &metricsHandler{
+		coll:     coll,
+		exporter: reg,
+		opts: promhttp.HandlerOpts{
 			// Opt into OpenMetrics to support exemplars.
 			EnableOpenMetrics: true,
 		},
-	))
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		_, _ = w.Write([]byte(`<html>
-			<head><title>Sonnenbatterie Exporter</title></head>
-			<body>
-			<h1>Sonnenbatterie Exporter</h1>
-			<p><a href="` + metricsPath + `">Metrics</a></p>
-			</body>
-			</html>`))
 	})
+	dashboard.Register(mux, dashboardOpts)
+
+	c = c.Append(hlog.AccessHandler(accessLog))
 
-	c = c.Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-		hlog.FromRequest(r).Info().
-			Str("method", r.Method).
-			Stringer("url", r.URL).
-			Int("status", status).
-			Int("size", size).
-			Dur("duration", duration).
-			Msg("")
-	}))
-
-	return http.ListenAndServe(addr, c.Then(mux))
+	server := &http.Server{
+		Addr:    addr,
+		Handler: c.Then(mux),
+		// end open streams on shutdown
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	// waited for like the background tasks, ListenAndServe returns as soon
+	// as the shutdown starts and requests may still be running
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		stop()
+		return err
+	}
+	log.Info().Msg("shutting down")
+	return nil
+}
+
+func accessLog(r *http.Request, status, size int, duration time.Duration) {
+	hlog.FromRequest(r).Info().
+		Str("method", r.Method).
+		Stringer("url", r.URL).
+		Int("status", status).
+		Int("size", size).
+		Dur("duration", duration).
+		Msg("")
 }
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "simulate":
+		err = runSimulate(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "docs":
+		err = writeMetricsDoc(os.Stdout)
+	default:
+		err = run()
+	}
+	if err != nil {
 		log.Fatal().Err(err).Msg("failed")
 	}
 }
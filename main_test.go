@@ -0,0 +1,840 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/api/apitest"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+func newTestRegistry(t *testing.T, token string) (*prometheus.Registry, *apitest.Server) {
+	t.Helper()
+	srv := apitest.NewServer()
+	t.Cleanup(srv.Close)
+	a, err := api.NewSonnenbatterie(srv.URL, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(newCollector(a, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	return reg, srv
+}
+
+func TestCollectStatus(t *testing.T) {
+	reg, srv := newTestRegistry(t, "")
+
+	expected := `
+# HELP solar_battery_charge_percent Solar battery charge in percent
+# TYPE solar_battery_charge_percent gauge
+solar_battery_charge_percent 7
+# HELP solar_battery_grid_frequency Solar battery Grid (AC) frequency in Hz
+# TYPE solar_battery_grid_frequency gauge
+solar_battery_grid_frequency 50.013
+# HELP solar_battery_pac_total Total AC power of battery, greaater zero is discharging, less than zero is charging
+# TYPE solar_battery_pac_total gauge
+solar_battery_pac_total 617
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"solar_battery_charge_percent", "solar_battery_grid_frequency", "solar_battery_pac_total"); err != nil {
+		t.Error(err)
+	}
+
+	// without a token only the public status endpoint is queried
+	for _, endpoint := range []string{apitest.EndpointPowerMeter, apitest.EndpointLatestData, apitest.EndpointBattery} {
+		if n := srv.Requests(endpoint); n != 0 {
+			t.Errorf("expected no requests to %s without token, got %d", endpoint, n)
+		}
+	}
+}
+
+func TestCollectWithToken(t *testing.T) {
+	reg, srv := newTestRegistry(t, "secret")
+	srv.SetToken("secret")
+
+	expected := `
+# HELP solar_battery_consumption_power Solar battery consumption power in watts
+# TYPE solar_battery_consumption_power gauge
+solar_battery_consumption_power{phase=""} 629
+solar_battery_consumption_power{phase="L1"} 427.5
+solar_battery_consumption_power{phase="L2"} 190.8
+solar_battery_consumption_power{phase="L3"} 21
+# HELP solar_battery_full_charge_capacity Full charge capacity in watt hours
+# TYPE solar_battery_full_charge_capacity gauge
+solar_battery_full_charge_capacity 15000
+# HELP solar_battery_cycle_count Cycle count of battery module
+# TYPE solar_battery_cycle_count gauge
+solar_battery_cycle_count 412
+# HELP solar_battery_device_time_unix_timestamp Local system time of the battery
+# TYPE solar_battery_device_time_unix_timestamp gauge
+solar_battery_device_time_unix_timestamp 1.735479905e+09
+# HELP solar_battery_last_fully_charged_unix_timestamp Timestamp of last full charge
+# TYPE solar_battery_last_fully_charged_unix_timestamp gauge
+solar_battery_last_fully_charged_unix_timestamp 1.735476305e+09
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"solar_battery_consumption_power", "solar_battery_full_charge_capacity", "solar_battery_cycle_count",
+		"solar_battery_device_time_unix_timestamp", "solar_battery_last_fully_charged_unix_timestamp"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectWithoutTimezone(t *testing.T) {
+	srv := apitest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.SetToken("secret")
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(newCollector(a, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a zone the battery's clock is neither exported nor used
+	n, err := testutil.GatherAndCount(reg, "solar_battery_device_time_unix_timestamp", "solar_battery_clock_skew_seconds")
+	if err != nil || n != 0 {
+		t.Errorf("expected no device clock metrics, got %d (%v)", n, err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(mfs, func(mf *dto.MetricFamily) bool {
+		return mf.GetName() == "solar_battery_last_fully_charged_unix_timestamp"
+	})
+	if i < 0 {
+		t.Fatal("missing solar_battery_last_fully_charged_unix_timestamp")
+	}
+	// an hour before the exporter's clock
+	expected := float64(time.Now().Add(-time.Hour).Unix())
+	if v := mfs[i].GetMetric()[0].GetGauge().GetValue(); v < expected-60 || v > expected+60 {
+		t.Errorf("expected last full charge relative to the exporter's clock, got %v", v)
+	}
+}
+
+func TestCollectV1WithToken(t *testing.T) {
+	srv := apitest.NewLegacyServer()
+	t.Cleanup(srv.Close)
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetVersion(api.VersionAuto)
+
+	var logs strings.Builder
+	defer func(l zerolog.Logger) { log = l }(log)
+	log = zerolog.New(&logs).Level(zerolog.InfoLevel)
+
+	// the sections v1 does not offer are skipped quietly
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(newCollector(a, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("expected no logs for unsupported sections, got %s", logs.String())
+	}
+	s := poller.New(a, time.Minute, time.Second, poller.Endpoints).Poll(context.Background())
+	if !s.OK() || len(s.Errors) != 0 {
+		t.Errorf("expected unsupported endpoints to be skipped, got errors %v", s.Errors)
+	}
+}
+
+func TestCollectFromSnapshot(t *testing.T) {
+	srv := apitest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.SetToken("secret")
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := newCollector(a, time.UTC)
+	p := poller.New(a, time.Minute, time.Second, poller.Endpoints)
+	coll.snapshot = p.Last
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(coll); err != nil {
+		t.Fatal(err)
+	}
+
+	// before the first poll the battery is queried directly
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	p.Poll(context.Background())
+	endpoints := []string{apitest.EndpointStatus, apitest.EndpointPowerMeter, apitest.EndpointLatestData, apitest.EndpointBattery}
+	requests := map[string]int{}
+	for _, endpoint := range endpoints {
+		requests[endpoint] = srv.Requests(endpoint)
+	}
+
+	expected := `
+# HELP solar_battery_charge_percent Solar battery charge in percent
+# TYPE solar_battery_charge_percent gauge
+solar_battery_charge_percent 7
+# HELP solar_battery_cycle_count Cycle count of battery module
+# TYPE solar_battery_cycle_count gauge
+solar_battery_cycle_count 412
+# HELP solar_battery_full_charge_capacity Full charge capacity in watt hours
+# TYPE solar_battery_full_charge_capacity gauge
+solar_battery_full_charge_capacity 15000
+# HELP solar_battery_last_fully_charged_unix_timestamp Timestamp of last full charge
+# TYPE solar_battery_last_fully_charged_unix_timestamp gauge
+solar_battery_last_fully_charged_unix_timestamp 1.735476305e+09
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"solar_battery_charge_percent", "solar_battery_cycle_count", "solar_battery_full_charge_capacity",
+		"solar_battery_last_fully_charged_unix_timestamp"); err != nil {
+		t.Error(err)
+	}
+	for _, endpoint := range endpoints {
+		if n := srv.Requests(endpoint); n != requests[endpoint] {
+			t.Errorf("expected the scrape to read %s from the snapshot, got %d new requests", endpoint, n-requests[endpoint])
+		}
+	}
+}
+
+func TestPollWithStatusCollectorDisabled(t *testing.T) {
+	srv := apitest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.SetToken("secret")
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := newCollector(a, time.UTC)
+	coll.enabled["status"] = false
+	p := poller.New(a, time.Minute, time.Second, poller.Endpoints)
+	coll.snapshot = p.Last
+	energy := newEnergyIntegrator(time.Minute)
+	p.Subscribe(energy.update)
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(coll); err != nil {
+		t.Fatal(err)
+	}
+
+	// the features built on the poller still get the status
+	if s := p.Poll(context.Background()); !s.OK() {
+		t.Fatalf("expected the status to be polled, got errors %v", s.Errors)
+	}
+	time.Sleep(10 * time.Millisecond)
+	p.Poll(context.Background())
+	if energy.state.DischargedWh <= 0 {
+		t.Errorf("expected the discharged energy to be integrated, got %+v", energy.state)
+	}
+
+	// but /metrics does not export it
+	n, err := testutil.GatherAndCount(reg, "solar_battery_charge_percent", "solar_battery_cycle_count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected only the battery metric, got %d metrics", n)
+	}
+}
+
+func TestCollectPartialFailure(t *testing.T) {
+	reg, srv := newTestRegistry(t, "secret")
+	srv.SetError(apitest.EndpointPowerMeter, http.StatusServiceUnavailable)
+	srv.SetMalformed(apitest.EndpointBattery, true)
+
+	n, err := testutil.GatherAndCount(reg,
+		"solar_battery_charge_percent", "solar_battery_consumption_energy_total", "solar_battery_cycle_count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the status metric survives, the failing endpoints are skipped
+	if n != 1 {
+		t.Errorf("expected 1 metric, got %d", n)
+	}
+}
+
+func TestCollectInverter(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := newCollector(a, time.UTC)
+	coll.enabled["inverter"] = true
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(coll); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP solar_battery_inverter_temperature_celsius Maximum inverter temperature in degrees celsius
+# TYPE solar_battery_inverter_temperature_celsius gauge
+solar_battery_inverter_temperature_celsius 47.5
+# HELP solar_battery_io_state State of digital inputs, outputs and relays, 1 if set
+# TYPE solar_battery_io_state gauge
+solar_battery_io_state{channel="DI_1"} 0
+solar_battery_io_state{channel="DI_2"} 1
+solar_battery_io_state{channel="DO_1"} 0
+solar_battery_io_state{channel="DO_2"} 1
+solar_battery_io_state{channel="relay_self_consumption"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"solar_battery_inverter_temperature_celsius", "solar_battery_io_state"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectBatteryModules(t *testing.T) {
+	reg, _ := newTestRegistry(t, "secret")
+
+	expected := `
+# HELP solar_battery_module_full_charge_capacity Full charge capacity of a single battery module
+# TYPE solar_battery_module_full_charge_capacity gauge
+solar_battery_module_full_charge_capacity{module="1"} 67.4
+solar_battery_module_full_charge_capacity{module="2"} 67.5
+solar_battery_module_full_charge_capacity{module="3"} 61.2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"solar_battery_module_full_charge_capacity"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetricsHandlerCollectFilter(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &metricsHandler{coll: newCollector(a, time.UTC), exporter: prometheus.NewRegistry()}
+
+	get := func(query string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics"+query, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := get("?collect[]=battery")
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	if !strings.Contains(body, "solar_battery_cycle_count") || strings.Contains(body, "solar_battery_charge_percent") {
+		t.Errorf("expected only battery metrics, got:\n%s", body)
+	}
+	if n := srv.Requests(apitest.EndpointStatus); n != 0 {
+		t.Errorf("expected status not to be queried, got %d requests", n)
+	}
+
+	if code, _ := get("?collect[]=inverter"); code != http.StatusBadRequest {
+		t.Errorf("expected disabled collector to be rejected, got %d", code)
+	}
+	if code, _ := get("?collect[]=nope"); code != http.StatusBadRequest {
+		t.Errorf("expected unknown collector to be rejected, got %d", code)
+	}
+}
+
+func TestDescribeCoversCollect(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := newCollector(a, time.UTC)
+	coll.enabled["inverter"] = true
+
+	// the pedantic registry fails on collected metrics that were not described
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(coll); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsDocUpToDate(t *testing.T) {
+	var b strings.Builder
+	if err := writeMetricsDoc(&b); err != nil {
+		t.Fatal(err)
+	}
+	current, err := os.ReadFile("METRICS.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != b.String() {
+		t.Error("METRICS.md is out of date, run go generate")
+	}
+}
+
+func TestCollectDerivedKPIs(t *testing.T) {
+	reg, srv := newTestRegistry(t, "")
+	if err := srv.SetPayload(apitest.EndpointStatus, map[string]any{
+		"Consumption_W": 1000,
+		"Production_W":  3000,
+		"Pac_total_W":   -500,
+		"GridFeedIn_W":  1500,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP solar_battery_grid_export_power Power fed into the grid in watts
+# TYPE solar_battery_grid_export_power gauge
+solar_battery_grid_export_power 1500
+# HELP solar_battery_grid_import_power Power drawn from the grid in watts
+# TYPE solar_battery_grid_import_power gauge
+solar_battery_grid_import_power 0
+# HELP solar_battery_self_consumption_ratio Share of the PV production used on site instead of fed into the grid, 0 to 1
+# TYPE solar_battery_self_consumption_ratio gauge
+solar_battery_self_consumption_ratio 0.5
+# HELP solar_battery_self_sufficiency_ratio Share of the consumption not drawn from the grid (autarky), 0 to 1
+# TYPE solar_battery_self_sufficiency_ratio gauge
+solar_battery_self_sufficiency_ratio 1
+# HELP solar_battery_battery_contribution_ratio Share of the consumption covered by discharging the battery, 0 to 1
+# TYPE solar_battery_battery_contribution_ratio gauge
+solar_battery_battery_contribution_ratio 0
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"solar_battery_grid_export_power", "solar_battery_grid_import_power", "solar_battery_self_consumption_ratio",
+		"solar_battery_self_sufficiency_ratio", "solar_battery_battery_contribution_ratio"); err != nil {
+		t.Error(err)
+	}
+
+	// without production there is no self consumption ratio
+	if err := srv.SetPayload(apitest.EndpointStatus, map[string]any{"Consumption_W": 500, "Pac_total_W": 400, "GridFeedIn_W": -100}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := testutil.GatherAndCount(reg, "solar_battery_self_consumption_ratio"); err != nil || n != 0 {
+		t.Errorf("expected no self consumption ratio, got %d (%v)", n, err)
+	}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP solar_battery_battery_contribution_ratio Share of the consumption covered by discharging the battery, 0 to 1
+# TYPE solar_battery_battery_contribution_ratio gauge
+solar_battery_battery_contribution_ratio 0.8
+`), "solar_battery_battery_contribution_ratio"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnergyCounters(t *testing.T) {
+	start := time.Date(2024, 12, 29, 12, 0, 0, 0, time.UTC)
+	snapshot := func(offset time.Duration, pac int, grid float64) *poller.Snapshot {
+		return &poller.Snapshot{Time: start.Add(offset), Status: &api.Status{PacTotalW: pac, GridFeedInW: grid}}
+	}
+
+	energy := newEnergyIntegrator(time.Hour)
+	energy.update(snapshot(0, 1000, 0))
+	// discharging 1000 W for half an hour: 500 Wh
+	energy.update(snapshot(30*time.Minute, 1000, 0))
+	// changing linearly to charging at 1000 W crosses zero after 15 minutes: 125 Wh each
+	energy.update(snapshot(time.Hour, -1000, 2000))
+	// the battery was unreachable, the gap is not integrated
+	energy.update(&poller.Snapshot{Time: start.Add(90 * time.Minute)})
+	energy.update(snapshot(3*time.Hour, -1000, -2000))
+
+	expected := energyState{ChargedWh: 125, DischargedWh: 625, GridExportWh: 500}
+	if energy.state != expected {
+		t.Errorf("expected %+v, got %+v", expected, energy.state)
+	}
+
+	// counters continue from the state file after a restart
+	path := t.TempDir() + "/state.json"
+	store, err := newStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.register("energy", energy); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = newStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newEnergyIntegrator(time.Hour)
+	if err := store.register("energy", restored); err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP solar_battery_charged_energy_wh_total Energy charged into the battery in watt hours
+# TYPE solar_battery_charged_energy_wh_total counter
+solar_battery_charged_energy_wh_total 125
+# HELP solar_battery_discharged_energy_wh_total Energy discharged from the battery in watt hours
+# TYPE solar_battery_discharged_energy_wh_total counter
+solar_battery_discharged_energy_wh_total 625
+`), "solar_battery_charged_energy_wh_total", "solar_battery_discharged_energy_wh_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeEstimate(t *testing.T) {
+	start := time.Date(2024, 12, 29, 12, 0, 0, 0, time.UTC)
+	snapshot := func(offset time.Duration, pac int, systemStatus string) *poller.Snapshot {
+		return &poller.Snapshot{
+			Time: start.Add(offset),
+			Status: &api.Status{
+				PacTotalW:           pac,
+				RemainingCapacityWh: 5000,
+				Rsoc:                50,
+				BackupBuffer:        "10",
+				SystemStatus:        systemStatus,
+			},
+		}
+	}
+
+	estimator := newRuntimeEstimator(5 * time.Minute)
+	estimator.update(snapshot(0, 3000, "OnGrid"))
+	// averaged with the previous poll: 4000 Wh above the 10 % buffer at 2000 W
+	estimator.update(snapshot(time.Minute, 1000, "OnGrid"))
+	if e := estimator.estimate; e.toEmpty == nil || *e.toEmpty != 2*time.Hour || e.toFull != nil {
+		t.Errorf("expected 2h to empty, got %+v", e)
+	}
+
+	// the first poll left the window, off grid the buffer is usable
+	estimator.update(snapshot(7*time.Minute, 1000, "OffGrid"))
+	if e := estimator.estimate; e.toEmpty == nil || *e.toEmpty != 5*time.Hour {
+		t.Errorf("expected 5h to empty, got %+v", e)
+	}
+
+	// the average turns to charging
+	estimator.update(snapshot(8*time.Minute, -8000, "OnGrid"))
+	estimator.update(snapshot(9*time.Minute, -5000, "OnGrid"))
+	if e := estimator.estimate; e.toFull == nil || *e.toFull != 75*time.Minute || e.toEmpty != nil {
+		t.Errorf("expected 75m to full, got %+v", e)
+	}
+}
+
+func TestHealthHistory(t *testing.T) {
+	start := time.Date(2024, 12, 29, 12, 0, 0, 0, time.UTC)
+	snapshot := func(offset time.Duration, sinceFull time.Duration, capacity int, cycles float64) *poller.Snapshot {
+		s := &poller.Snapshot{
+			Time:       start.Add(offset),
+			LatestData: &api.LatestData{FullChargeCapacity: capacity},
+			Battery:    &api.BatteryModuleData{CycleCount: cycles},
+		}
+		s.LatestData.IcStatus.SecondsSinceFullCharge = int(sinceFull.Seconds())
+		return s
+	}
+
+	health := newHealthTracker(10000)
+	// a full charge before startup is not recorded
+	health.update(snapshot(0, time.Hour, 9600, 99))
+	if len(health.history) != 0 {
+		t.Fatalf("expected no full charge, got %+v", health.history)
+	}
+	health.update(snapshot(2*time.Hour, 30*time.Minute, 9500, 100))
+	// the same full charge polled again
+	health.update(snapshot(2*time.Hour+10*time.Second, 30*time.Minute+10*time.Second, 9500, 100))
+	health.update(snapshot(24*time.Hour, 2*time.Hour, 9400, 101))
+	if len(health.history) != 2 {
+		t.Fatalf("expected 2 full charges, got %+v", health.history)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(health); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP solar_battery_state_of_health_ratio Full charge capacity relative to the nominal capacity
+# TYPE solar_battery_state_of_health_ratio gauge
+solar_battery_state_of_health_ratio 0.94
+`), "solar_battery_state_of_health_ratio"); err != nil {
+		t.Error(err)
+	}
+
+	rec := httptest.NewRecorder()
+	health.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/capacity-history?format=csv", nil))
+	expected := `time,cycle_count,full_charge_capacity_wh,state_of_health
+2024-12-29T13:30:00Z,100,9500,0.9500
+2024-12-30T10:00:00Z,101,9400,0.9400
+`
+	if rec.Body.String() != expected {
+		t.Errorf("unexpected history:\n%s", rec.Body.String())
+	}
+
+	// after a restart, full charges since the last persisted one are recorded
+	state, err := health.marshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newHealthTracker(10000)
+	if err := restarted.restoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	restarted.update(snapshot(48*time.Hour, 3*time.Hour, 9300, 102))
+	if n := len(restarted.history); n != 3 || restarted.history[n-1].CycleCount != 102 {
+		t.Errorf("expected the full charge after the last record, got %+v", restarted.history)
+	}
+}
+
+func TestThresholdChecks(t *testing.T) {
+	reg, srv := newTestRegistry(t, "token")
+	if err := srv.SetPayload(apitest.EndpointBattery, map[string]any{
+		"maximumcellvoltage":     3.5,
+		"minimumcellvoltage":     3.25,
+		"maximumcelltemperature": 30,
+		"minimumcelltemperature": 18,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP solar_battery_cell_voltage_spread_volts Difference between the highest and lowest cell voltage in volts
+# TYPE solar_battery_cell_voltage_spread_volts gauge
+solar_battery_cell_voltage_spread_volts 0.25
+# HELP solar_battery_threshold_exceeded Whether a cell balance or temperature check is outside its limit, 1 if exceeded
+# TYPE solar_battery_threshold_exceeded gauge
+solar_battery_threshold_exceeded{check="cell_temperature_delta"} 1
+solar_battery_threshold_exceeded{check="cell_temperature_high"} 0
+solar_battery_threshold_exceeded{check="cell_temperature_low"} 0
+solar_battery_threshold_exceeded{check="cell_voltage_spread"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"solar_battery_cell_voltage_spread_volts", "solar_battery_threshold_exceeded"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEventEngine(t *testing.T) {
+	start := time.Date(2024, 12, 29, 12, 0, 0, 0, time.UTC)
+	var polls int
+	snapshot := func(status api.Status, alarm float64) *poller.Snapshot {
+		polls++
+		return &poller.Snapshot{
+			Time:    start.Add(time.Duration(polls) * 10 * time.Second),
+			Status:  &status,
+			Battery: &api.BatteryModuleData{SystemAlarm: alarm, MaximumCellTemperature: 20, MinimumCellTemperature: 18},
+		}
+	}
+	failed := &poller.Snapshot{Time: start, Errors: map[string]string{poller.EndpointStatus: "timeout"}}
+
+	var events []string
+	engine := newEventEngine(defaultThresholds(), 10, func(ev event) {
+		events = append(events, ev.key())
+	})
+
+	normal := api.Status{SystemStatus: "OnGrid", OperatingMode: "2", Usoc: 50}
+	engine.update(snapshot(normal, 0))
+	engine.update(snapshot(normal, 0))
+	if len(events) != 0 {
+		t.Fatalf("expected no events without transitions, got %v", events)
+	}
+
+	outage := normal
+	outage.SystemStatus = "OffGrid"
+	outage.Usoc = 8
+	engine.update(snapshot(outage, 4))
+	// still low, no repeated event
+	engine.update(snapshot(outage, 4))
+	for range lostContactPolls {
+		engine.update(failed)
+	}
+	full := normal
+	full.Usoc = 100
+	full.OperatingMode = "1"
+	engine.update(snapshot(full, 0))
+
+	expected := []string{
+		"off_grid/", "soc_low/", "alarm_set/2",
+		"lost_contact/",
+		"contact_restored/", "on_grid/", "mode_changed/", "battery_full/", "alarm_cleared/2",
+	}
+	if !slices.Equal(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	var attempts int
+	received := make(chan event, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// fail the first attempt to exercise the retry
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	t.Cleanup(srv.Close)
+
+	n := newNotifier(notifyOptions{Webhooks: []string{srv.URL}, DedupWindow: time.Minute, MaxPerHour: 1})
+	n.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go n.run(ctx)
+
+	now := time.Now()
+	n.notify(event{Type: "off_grid", Time: now})
+	// duplicate within the window
+	n.notify(event{Type: "off_grid", Time: now.Add(time.Second)})
+	// recoveries are neither rate limited nor deduplicated
+	n.notify(event{Type: "on_grid", Time: now.Add(2 * time.Second)})
+	// over the rate limit
+	n.notify(event{Type: "soc_low", Time: now.Add(3 * time.Second)})
+	n.notify(event{Type: "contact_restored", Time: now.Add(4 * time.Second)})
+	n.notify(event{Type: "contact_restored", Time: now.Add(5 * time.Second)})
+
+	for _, typ := range []string{"off_grid", "on_grid", "contact_restored", "contact_restored"} {
+		select {
+		case ev := <-received:
+			if ev.Type != typ {
+				t.Errorf("expected %s, got %s", typ, ev.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", typ)
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for result, expected := range map[string]int{"deduplicated": 1, "rate_limited": 1} {
+		if v := n.results[result]; v != expected {
+			t.Errorf("expected %v %s events, got %v", expected, result, v)
+		}
+	}
+}
+
+// fakeScheduleBattery records the write calls of the scheduler.
+type fakeScheduleBattery struct {
+	status api.Status
+	calls  []string
+}
+
+func (b *fakeScheduleBattery) GetStatus(context.Context) (*api.Status, error) {
+	status := b.status
+	return &status, nil
+}
+
+func (b *fakeScheduleBattery) SetOperatingMode(_ context.Context, mode string) error {
+	b.status.OperatingMode = api.FlexString(mode)
+	b.calls = append(b.calls, "mode "+mode)
+	return nil
+}
+
+func (b *fakeScheduleBattery) Charge(_ context.Context, watts int) error {
+	b.calls = append(b.calls, "charge "+strconv.Itoa(watts))
+	return nil
+}
+
+func (b *fakeScheduleBattery) Discharge(_ context.Context, watts int) error {
+	b.calls = append(b.calls, "discharge "+strconv.Itoa(watts))
+	return nil
+}
+
+func TestSchedule(t *testing.T) {
+	var windows []*scheduleWindow
+	for _, spec := range []string{"charge 3kW 02:00-05:00 soc<60", "hold 17:00-20:00 mon-fri", "discharge 2000W 22:00-01:00 sat"} {
+		w, err := parseScheduleWindow(spec, 3300, 3300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows = append(windows, w)
+	}
+	for _, spec := range []string{"charge 02:00-05:00", "boost 3kW 02:00-05:00", "hold 05:00-05:00", "hold 17:00-20:00 soc=5", "hold 17:00-20:00 funday", "charge 5kW 02:00-05:00", "discharge 2500W 22:00-01:00", "charge 0.0001kW 02:00-05:00"} {
+		if _, err := parseScheduleWindow(spec, 3300, 2000); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+
+	battery := &fakeScheduleBattery{status: api.Status{OperatingMode: api.ModeSelfConsumption, Usoc: 40}}
+	sched := newScheduler(battery, windows, time.UTC)
+	ctx := context.Background()
+	// a monday
+	day := time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC)
+	step := func(at time.Duration, soc float64, calls ...string) {
+		t.Helper()
+		battery.status.Usoc = api.FlexFloat(soc)
+		battery.calls = nil
+		sched.step(ctx, day.Add(at))
+		if !slices.Equal(battery.calls, calls) {
+			t.Errorf("at %s: expected calls %v, got %v", day.Add(at), calls, battery.calls)
+		}
+	}
+
+	step(1*time.Hour, 40)
+	step(2*time.Hour, 40, "mode 1", "charge 3000")
+	if err := testutil.CollectAndCompare(sched, strings.NewReader(`
+# HELP solar_battery_schedule_setpoint_watts Battery power requested by the schedule window in effect, greater zero is discharging
+# TYPE solar_battery_schedule_setpoint_watts gauge
+solar_battery_schedule_setpoint_watts -3000
+# HELP solar_battery_schedule_window_active Whether the schedule window is in effect
+# TYPE solar_battery_schedule_window_active gauge
+solar_battery_schedule_window_active{window="charge 3kW 02:00-05:00 soc<60"} 1
+solar_battery_schedule_window_active{window="discharge 2000W 22:00-01:00 sat"} 0
+solar_battery_schedule_window_active{window="hold 17:00-20:00 mon-fri"} 0
+`), "solar_battery_schedule_setpoint_watts", "solar_battery_schedule_window_active"); err != nil {
+		t.Error(err)
+	}
+	step(3*time.Hour, 50)
+	// switched back by someone else
+	battery.status.OperatingMode = api.ModeSelfConsumption
+	step(3*time.Hour+30*time.Minute, 50, "mode 1", "charge 3000")
+	// the condition stops the window for the rest of this occurrence
+	step(4*time.Hour, 60, "mode 2")
+	step(4*time.Hour+30*time.Minute, 55)
+	step(17*time.Hour, 55, "mode 1", "charge 0")
+	step(20*time.Hour, 55, "mode 2")
+	// the mode is left alone outside of windows
+	battery.status.OperatingMode = api.ModeManual
+	step(21*time.Hour, 55)
+
+	// saturday's window wraps into sunday
+	battery.status.OperatingMode = api.ModeSelfConsumption
+	step(5*24*time.Hour+23*time.Hour, 55, "mode 1", "discharge 2000")
+	step(6*24*time.Hour+30*time.Minute, 55)
+	step(6*24*time.Hour+time.Hour, 55, "mode 2")
+
+	// a restart outside of windows restores self consumption
+	step(7*24*time.Hour+17*time.Hour, 55, "mode 1", "charge 0")
+	state, err := sched.marshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newScheduler(battery, windows, time.UTC)
+	if err := restarted.restoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	battery.calls = nil
+	restarted.step(ctx, day.Add(7*24*time.Hour+21*time.Hour))
+	if !slices.Equal(battery.calls, []string{"mode 2"}) {
+		t.Errorf("expected self consumption to be restored after a restart, got %v", battery.calls)
+	}
+
+	// shutdown restores self consumption
+	battery.status.OperatingMode = api.ModeSelfConsumption
+	step(7*24*time.Hour+17*time.Hour, 55, "mode 1", "charge 0")
+	battery.calls = nil
+	sched.restore(ctx)
+	if !slices.Equal(battery.calls, []string{"mode 2"}) {
+		t.Errorf("expected self consumption to be restored, got %v", battery.calls)
+	}
+}
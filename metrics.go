@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+const (
+	gauge   = prometheus.GaugeValue
+	counter = prometheus.CounterValue
+)
+
+// metric describes one exported metric and how its samples are extracted
+// from the document T fetched by a collector section. Several sections may
+// export the same metric, e.g. the grid voltage of the status and the power
+// meters, as long as help and labels agree.
+type metric[T any] struct {
+	name   string
+	help   string
+	unit   string
+	typ    prometheus.ValueType
+	labels []string
+	value  func(T) []sample
+}
+
+// sample is a single value with values for the metric's labels.
+type sample struct {
+	value  float64
+	labels []string
+}
+
+func one(value float64, labels ...string) []sample {
+	return []sample{{value, labels}}
+}
+
+type metricTable[T any] []metric[T]
+
+func (t metricTable[T]) docs() []metricDoc {
+	docs := make([]metricDoc, len(t))
+	for i, m := range t {
+		docs[i] = metricDoc{m.name, m.help, m.unit, m.typ, m.labels}
+	}
+	return docs
+}
+
+// describe sends the descriptors of all metrics of the table.
+func (t metricTable[T]) describe(ch chan<- *prometheus.Desc) {
+	for _, m := range t {
+		ch <- descriptors.get(m.name)
+	}
+}
+
+// collect sends the samples of all metrics of the table for doc.
+func (t metricTable[T]) collect(ch chan<- prometheus.Metric, doc T) {
+	for _, m := range t {
+		desc := descriptors.get(m.name)
+		for _, s := range m.value(doc) {
+			ch <- prometheus.MustNewConstMetric(desc, m.typ, s.value, s.labels...)
+		}
+	}
+}
+
+type metricDoc struct {
+	name   string
+	help   string
+	unit   string
+	typ    prometheus.ValueType
+	labels []string
+}
+
+type documented interface {
+	docs() []metricDoc
+}
+
+// statusDoc is the status document with its parsed timestamp.
+type statusDoc struct {
+	*api.Status
+	// zero if the timestamp could not be parsed
+	time time.Time
+	// the exporter's time the status was fetched at
+	fetched time.Time
+}
+
+type powerMeters struct {
+	production  *api.PowerMeter
+	consumption *api.PowerMeter
+}
+
+// latestDataDoc is the latest data document together with the reference time
+// for derived timestamps.
+type latestDataDoc struct {
+	*api.LatestData
+	now time.Time
+}
+
+var statusMetrics = metricTable[*statusDoc]{
+	{"solar_battery_grid_voltage", "Solar battery Grid (AC) voltage", "volts", gauge, []string{"phase"}, func(s *statusDoc) []sample { return one(s.Uac, "") }},
+	{"solar_battery_grid_frequency", "Solar battery Grid (AC) frequency in Hz", "hertz", gauge, nil, func(s *statusDoc) []sample { return one(s.Fac) }},
+	{"solar_battery_charge_percent", "Solar battery charge in percent", "percent", gauge, nil, func(s *statusDoc) []sample { return one(float64(s.Rsoc)) }},
+	{"solar_battery_usable_charge_percent", "Solar battery usable charge in percent", "percent", gauge, nil, func(s *statusDoc) []sample { return one(float64(s.Usoc)) }},
+	{"solar_battery_consumption_power", "Solar battery consumption power in watts", "watts", gauge, []string{"phase"}, func(s *statusDoc) []sample { return one(float64(s.ConsumptionW), "") }},
+	{"solar_battery_production_power", "Solar battery production power in watts", "watts", gauge, []string{"phase"}, func(s *statusDoc) []sample { return one(float64(s.ProductionW), "") }},
+	{"solar_battery_remaining_charge_capacity", "Remaining charge capacity in watt hours", "watt hours", gauge, nil, func(s *statusDoc) []sample { return one(float64(s.RemainingCapacityWh)) }},
+	{"solar_battery_pac_total", "Total AC power of battery, greaater zero is discharging, less than zero is charging", "watts", gauge, nil, func(s *statusDoc) []sample { return one(float64(s.PacTotalW)) }},
+	{"solar_battery_device_time_unix_timestamp", "Local system time of the battery", "seconds", gauge, nil, func(s *statusDoc) []sample {
+		if s.time.IsZero() {
+			return nil
+		}
+		return one(unixSeconds(s.time))
+	}},
+	{"solar_battery_clock_skew_seconds", "Difference between the battery's system time and the exporter's clock, positive if the battery is ahead", "seconds", gauge, nil, func(s *statusDoc) []sample {
+		if s.time.IsZero() {
+			return nil
+		}
+		return one(s.time.Sub(s.fetched).Seconds())
+	}},
+}
+
+var powerMeterMetrics = metricTable[*powerMeters]{
+	{"solar_battery_grid_voltage", "Solar battery Grid (AC) voltage", "volts", gauge, []string{"phase"}, func(m *powerMeters) []sample {
+		c := m.consumption
+		return []sample{
+			{c.VL1N, []string{"L1"}},
+			{c.VL2N, []string{"L2"}},
+			{c.VL3N, []string{"L3"}},
+			{c.VL1L2, []string{"L1-L2"}},
+			{c.VL2L3, []string{"L2-L3"}},
+			{c.VL3L1, []string{"L3-L1"}},
+		}
+	}},
+	{"solar_battery_consumption_power", "Solar battery consumption power in watts", "watts", gauge, []string{"phase"}, func(m *powerMeters) []sample { return phases(m.consumption) }},
+	{"solar_battery_consumption_energy_total", "Total consumption measured in kwH", "kilowatt hours", counter, nil, func(m *powerMeters) []sample { return one(m.consumption.KwhImported) }},
+	{"solar_battery_production_power", "Solar battery production power in watts", "watts", gauge, []string{"phase"}, func(m *powerMeters) []sample { return phases(m.production) }},
+	{"solar_battery_production_energy_total", "Total production measured in kwH", "kilowatt hours", counter, nil, func(m *powerMeters) []sample { return one(m.production.KwhImported) }},
+}
+
+func phases(m *api.PowerMeter) []sample {
+	return []sample{
+		{m.WL1, []string{"L1"}},
+		{m.WL2, []string{"L2"}},
+		{m.WL3, []string{"L3"}},
+	}
+}
+
+var latestDataMetrics = metricTable[*latestDataDoc]{
+	{"solar_battery_last_fully_charged_unix_timestamp", "Timestamp of last full charge", "seconds", gauge, nil, func(l *latestDataDoc) []sample {
+		return one(unixSeconds(l.now.Add(-time.Duration(l.IcStatus.SecondsSinceFullCharge) * time.Second)))
+	}},
+	{"solar_battery_full_charge_capacity", "Full charge capacity in watt hours", "watt hours", gauge, nil, func(l *latestDataDoc) []sample { return one(float64(l.FullChargeCapacity)) }},
+}
+
+var batteryMetrics = metricTable[*api.BatteryModuleData]{
+	{"solar_battery_cycle_count", "Cycle count of battery module", "", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.CycleCount) }},
+	{"solar_battery_maximum_cell_temperature", "Maximum cell temperature of battery", "celsius", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.MaximumCellTemperature) }},
+	{"solar_battery_maximum_cell_voltage", "Maximum cell voltage of battery", "volts", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.MaximumCellVoltage) }},
+	{"solar_battery_maximum_module_current", "Maximum module current of battery", "amperes", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.MaximumModuleCurrent) }},
+	{"solar_battery_maximum_module_dc_voltage", "Maximum module DC voltage of battery", "volts", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.MaximumModuleDCVoltage) }},
+	{"solar_battery_minimum_cell_temperature", "Minimum cell temperature of battery", "celsius", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.MinimumCellTemperature) }},
+	{"solar_battery_minimum_cell_voltage", "Minimum cell voltage of battery", "volts", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.MinimumCellVoltage) }},
+	{"solar_battery_minimum_module_current", "Minimum module current of battery", "amperes", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.MinimumModuleCurrent) }},
+	{"solar_battery_minimum_module_dc_voltage", "Minimum module DC voltage of battery", "volts", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.MinimumModuleDCVoltage) }},
+	{"solar_battery_relative_state_of_charge", "Relative state of charge of battery", "percent", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.RelativeStateOfCharge) }},
+	{"solar_battery_remaining_capacity", "Remaining capacity of battery", "", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.RemainingCapacity) }},
+	{"solar_battery_system_alarm", "System alarm status of battery", "", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.SystemAlarm) }},
+	{"solar_battery_system_current", "System current of battery", "amperes", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.SystemCurrent) }},
+	{"solar_battery_system_voltage", "System voltage of battery", "volts", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.SystemVoltage) }},
+	{"solar_battery_system_dc_voltage", "System DC voltage of battery", "volts", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.SystemDCVoltage) }},
+	{"solar_battery_system_status", "System status of battery", "", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.SystemStatus) }},
+	{"solar_battery_system_warning", "System warning status of battery", "", gauge, nil, func(b *api.BatteryModuleData) []sample { return one(b.SystemWarning) }},
+
+	{"solar_battery_module_cycle_count", "Cycle count of a single battery module", "", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.CycleCount })},
+	{"solar_battery_module_full_charge_capacity", "Full charge capacity of a single battery module", "", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.FullChargeCapacity })},
+	{"solar_battery_module_maximum_cell_temperature", "Maximum cell temperature of a single battery module", "celsius", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.MaximumCellTemperature })},
+	{"solar_battery_module_maximum_cell_voltage", "Maximum cell voltage of a single battery module", "volts", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.MaximumCellVoltage })},
+	{"solar_battery_module_minimum_cell_temperature", "Minimum cell temperature of a single battery module", "celsius", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.MinimumCellTemperature })},
+	{"solar_battery_module_minimum_cell_voltage", "Minimum cell voltage of a single battery module", "volts", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.MinimumCellVoltage })},
+	{"solar_battery_module_current", "Current of a single battery module", "amperes", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.ModuleCurrent })},
+	{"solar_battery_module_dc_voltage", "DC voltage of a single battery module", "volts", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.ModuleDCVoltage })},
+	{"solar_battery_module_relative_state_of_charge", "Relative state of charge of a single battery module", "percent", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.RelativeStateOfCharge })},
+	{"solar_battery_module_remaining_capacity", "Remaining capacity of a single battery module", "", gauge, []string{"module"}, perModule(func(m api.BatteryModule) float64 { return m.RemainingCapacity })},
+}
+
+func perModule(value func(api.BatteryModule) float64) func(*api.BatteryModuleData) []sample {
+	return func(b *api.BatteryModuleData) []sample {
+		samples := make([]sample, len(b.Modules))
+		for i, m := range b.Modules {
+			samples[i] = sample{value(m), []string{b.ModuleName(i)}}
+		}
+		return samples
+	}
+}
+
+var inverterMetrics = metricTable[*api.Inverter]{
+	{"solar_battery_inverter_temperature_celsius", "Maximum inverter temperature in degrees celsius", "celsius", gauge, nil, func(i *api.Inverter) []sample { return one(i.Tmax) }},
+	{"solar_battery_inverter_ac_power", "Inverter AC power in watts, greater zero is discharging", "watts", gauge, nil, func(i *api.Inverter) []sample { return one(i.PacTotal) }},
+	{"solar_battery_inverter_ac_voltage", "Inverter AC voltage in volts", "volts", gauge, nil, func(i *api.Inverter) []sample { return one(i.Uac) }},
+	{"solar_battery_inverter_ac_current", "Inverter AC current over all phases in amperes", "amperes", gauge, nil, func(i *api.Inverter) []sample { return one(i.IacTotal) }},
+	{"solar_battery_inverter_battery_power", "Inverter battery side power in watts", "watts", gauge, nil, func(i *api.Inverter) []sample { return one(i.Pbat) }},
+	{"solar_battery_inverter_battery_voltage", "Inverter battery side voltage in volts", "volts", gauge, nil, func(i *api.Inverter) []sample { return one(i.Ubat) }},
+	{"solar_battery_inverter_battery_current", "Inverter battery side current in amperes", "amperes", gauge, nil, func(i *api.Inverter) []sample { return one(i.Ibat) }},
+	{"solar_battery_inverter_pv_power", "Inverter PV input power in watts", "watts", gauge, nil, func(i *api.Inverter) []sample { return one(i.Ppv) }},
+	{"solar_battery_inverter_pv_voltage", "Inverter PV input voltage in volts", "volts", gauge, nil, func(i *api.Inverter) []sample { return one(i.Upv) }},
+	{"solar_battery_inverter_pv_current", "Inverter PV input current in amperes", "amperes", gauge, nil, func(i *api.Inverter) []sample { return one(i.Ipv) }},
+	{"solar_battery_inverter_dc_link_voltage", "Inverter DC link voltage in volts", "volts", gauge, nil, func(i *api.Inverter) []sample { return one(i.Udc) }},
+}
+
+var ioMetrics = metricTable[*api.IO]{
+	{"solar_battery_io_state", "State of digital inputs, outputs and relays, 1 if set", "", gauge, []string{"channel"}, func(s *api.IO) []sample {
+		samples := make([]sample, 0, len(s.Channels))
+		for channel, state := range s.Channels {
+			samples = append(samples, sample{state, []string{channel}})
+		}
+		return samples
+	}},
+}
+
+// sectionTables maps the collector sections to the tables they export.
+var sectionTables = []struct {
+	section string
+	tables  []documented
+}{
+	{"status", []documented{statusMetrics, derivedMetrics}},
+	{"powermeter", []documented{powerMeterMetrics}},
+	{"latestdata", []documented{latestDataMetrics}},
+	{"battery", []documented{batteryMetrics, balanceMetrics}},
+	{"inverter", []documented{inverterMetrics, ioMetrics}},
+	// not a collector section, integrated from the background poller
+	{"poller", []documented{energyMetrics, estimateMetrics, healthMetrics}},
+	// not collector sections, the state of the exporter's own features
+	{"schedule", []documented{scheduleMetrics}},
+	{"strict-schema", []documented{schemaMetrics}},
+	{"notifications", []documented{notifyMetrics}},
+	{"stream", []documented{streamMetrics}},
+}
+
+// descriptors holds one descriptor per metric name of all tables.
+var descriptors = newDescriptorSet()
+
+type descriptorSet struct {
+	names []string
+	docs  map[string]metricDoc
+	descs map[string]*prometheus.Desc
+	// metric names by section
+	sections map[string][]string
+}
+
+// newDescriptorSet builds the descriptors of all tables. It panics if two
+// tables disagree on a shared metric, as the registry would reject them.
+func newDescriptorSet() *descriptorSet {
+	set := &descriptorSet{
+		docs:     map[string]metricDoc{},
+		descs:    map[string]*prometheus.Desc{},
+		sections: map[string][]string{},
+	}
+	for _, st := range sectionTables {
+		for _, t := range st.tables {
+			for _, doc := range t.docs() {
+				if !slices.Contains(set.sections[st.section], doc.name) {
+					set.sections[st.section] = append(set.sections[st.section], doc.name)
+				}
+				if prev, ok := set.docs[doc.name]; ok {
+					if prev.help != doc.help || prev.typ != doc.typ || !slices.Equal(prev.labels, doc.labels) {
+						panic(fmt.Sprintf("conflicting definitions of metric %s", doc.name))
+					}
+					continue
+				}
+				set.names = append(set.names, doc.name)
+				set.docs[doc.name] = doc
+				set.descs[doc.name] = prometheus.NewDesc(doc.name, doc.help, doc.labels, nil)
+			}
+		}
+	}
+	return set
+}
+
+func (s *descriptorSet) get(name string) *prometheus.Desc {
+	desc, ok := s.descs[name]
+	if !ok {
+		panic("undescribed metric " + name)
+	}
+	return desc
+}
+
+// writeMetricsDoc writes a markdown table of all metrics the collector
+// exports.
+func writeMetricsDoc(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("<!-- generated by `go generate`, do not edit -->\n\n")
+	b.WriteString("# Metrics\n\n")
+	b.WriteString("| Metric | Type | Unit | Labels | Collector | Help |\n")
+	b.WriteString("|--------|------|------|--------|-----------|------|\n")
+
+	sections := map[string][]string{}
+	for _, st := range sectionTables {
+		for _, t := range st.tables {
+			for _, doc := range t.docs() {
+				if !slices.Contains(sections[doc.name], st.section) {
+					sections[doc.name] = append(sections[doc.name], st.section)
+				}
+			}
+		}
+	}
+
+	names := slices.Clone(descriptors.names)
+	slices.Sort(names)
+	for _, name := range names {
+		doc := descriptors.docs[name]
+		typ := "gauge"
+		if doc.typ == counter {
+			typ = "counter"
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s | %s | %s |\n",
+			name, typ, doc.unit, strings.Join(doc.labels, ", "), strings.Join(sections[name], ", "), doc.help)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
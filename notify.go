@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// notifyQueueSize is the number of events waiting for delivery before
+	// new ones are dropped
+	notifyQueueSize = 100
+	// notifyAttempts is the number of delivery attempts per target
+	notifyAttempts = 4
+)
+
+// notifyOptions configures the event notifications.
+type notifyOptions struct {
+	// generic webhooks receiving the event as JSON
+	Webhooks []string
+	// ntfy topic URLs, e.g. https://ntfy.sh/my-battery
+	Ntfy []string
+	// events with the same type and subject within this window are dropped
+	DedupWindow time.Duration
+	// maximum number of events sent per hour
+	MaxPerHour int
+	// recoveries are exempt from both, so a problem that was reported is
+	// always reported cleared
+	// usable charge in percent below which a soc_low event is sent
+	SocLow float64
+}
+
+func (o notifyOptions) enabled() bool {
+	return len(o.Webhooks) > 0 || len(o.Ntfy) > 0
+}
+
+// notifier delivers events to the configured targets in the background,
+// after deduplication and rate limiting.
+type notifier struct {
+	opts   notifyOptions
+	client *http.Client
+	// backoff is the delay before the first retry, doubled for each further
+	// one
+	backoff time.Duration
+	queue   chan event
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	sent []time.Time
+	// number of events by the result of their notification
+	results notifyResults
+}
+
+type notifyResults = map[string]int
+
+var notifyMetrics = metricTable[notifyResults]{
+	{"solar_battery_notifications_total", "Events by the result of their notification", "", counter, []string{"result"}, func(r notifyResults) []sample {
+		samples := make([]sample, 0, len(r))
+		for result, n := range r {
+			samples = append(samples, sample{float64(n), []string{result}})
+		}
+		return samples
+	}},
+}
+
+func newNotifier(opts notifyOptions) *notifier {
+	return &notifier{
+		opts:    opts,
+		client:  &http.Client{Timeout: timeout},
+		backoff: time.Second,
+		queue:   make(chan event, notifyQueueSize),
+		seen:    map[string]time.Time{},
+		results: notifyResults{},
+	}
+}
+
+// notify queues the event unless it is a duplicate or the rate limit is
+// reached. It does not block.
+func (n *notifier) notify(ev event) {
+	if result := n.admit(ev); result != "" {
+		n.count(result)
+		log.Info().Str("event", ev.Type).Str("subject", ev.Subject).Str("result", result).Msg("notification skipped")
+		return
+	}
+	select {
+	case n.queue <- ev:
+	default:
+		n.count("dropped")
+		log.Error().Str("event", ev.Type).Msg("notification queue full, dropping event")
+	}
+}
+
+// admit returns why the event is not sent, or "" if it is.
+func (n *notifier) admit(ev event) string {
+	if ev.recovery() {
+		return ""
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if last, ok := n.seen[ev.key()]; ok && ev.Time.Sub(last) < n.opts.DedupWindow {
+		return "deduplicated"
+	}
+	for len(n.sent) > 0 && ev.Time.Sub(n.sent[0]) >= time.Hour {
+		n.sent = n.sent[1:]
+	}
+	if n.opts.MaxPerHour > 0 && len(n.sent) >= n.opts.MaxPerHour {
+		return "rate_limited"
+	}
+	n.seen[ev.key()] = ev.Time
+	n.sent = append(n.sent, ev.Time)
+	return ""
+}
+
+// run delivers queued events until ctx is done.
+func (n *notifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-n.queue:
+			n.deliver(ctx, ev)
+		}
+	}
+}
+
+func (n *notifier) deliver(ctx context.Context, ev event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode event")
+		return
+	}
+
+	result := "sent"
+	for _, url := range n.opts.Webhooks {
+		err := n.post(ctx, url, body, map[string]string{"Content-Type": "application/json"})
+		if err != nil {
+			result = "failed"
+			log.Error().Err(err).Str("event", ev.Type).Msg("failed to deliver webhook")
+		}
+	}
+	for _, url := range n.opts.Ntfy {
+		err := n.post(ctx, url, []byte(ev.Message), map[string]string{
+			"Title":    "Sonnenbatterie: " + strings.ReplaceAll(ev.Type, "_", " "),
+			"Priority": ntfyPriority(ev.Severity),
+			"Tags":     ev.Severity,
+		})
+		if err != nil {
+			result = "failed"
+			log.Error().Err(err).Str("event", ev.Type).Msg("failed to deliver ntfy notification")
+		}
+	}
+	n.count(result)
+}
+
+func (n *notifier) count(result string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.results[result]++
+}
+
+// post sends the body, retrying with exponential backoff on network errors,
+// rate limiting and server errors.
+func (n *notifier) post(ctx context.Context, url string, body []byte, header map[string]string) error {
+	backoff := n.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = n.send(ctx, url, body, header)
+		if err == nil || !retry || attempt == notifyAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send makes one attempt and reports whether a failure is worth retrying.
+func (n *notifier) send(ctx context.Context, url string, body []byte, header map[string]string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	return false, nil
+}
+
+func ntfyPriority(severity string) string {
+	switch severity {
+	case severityCritical:
+		return "urgent"
+	case severityWarning:
+		return "high"
+	default:
+		return "default"
+	}
+}
+
+// stringsFlag is a flag that can be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// Describe implements Collector.
+func (n *notifier) Describe(ch chan<- *prometheus.Desc) {
+	notifyMetrics.describe(ch)
+}
+
+// Collect implements Collector.
+func (n *notifier) Collect(ch chan<- prometheus.Metric) {
+	n.mu.Lock()
+	results := maps.Clone(n.results)
+	n.mu.Unlock()
+	notifyMetrics.collect(ch, results)
+}
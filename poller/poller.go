@@ -0,0 +1,175 @@
+// Package poller periodically fetches the battery state in the background,
+// independent of Prometheus scrapes, and hands each snapshot to subscribers.
+package poller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+// Names of the polled endpoints.
+const (
+	EndpointStatus     = "status"
+	EndpointPowerMeter = "powermeter"
+	EndpointLatestData = "latestdata"
+	EndpointBattery    = "battery"
+)
+
+// Endpoints are all endpoints a poll may query.
+var Endpoints = []string{EndpointStatus, EndpointPowerMeter, EndpointLatestData, EndpointBattery}
+
+// Snapshot is the battery state fetched by one poll. Documents that could
+// not be fetched are nil and their error is listed in Errors.
+type Snapshot struct {
+	// Time the poll started
+	Time time.Time `json:"time"`
+
+	Status      *api.Status            `json:"status,omitempty"`
+	Production  *api.PowerMeter        `json:"production,omitempty"`
+	Consumption *api.PowerMeter        `json:"consumption,omitempty"`
+	LatestData  *api.LatestData        `json:"latestdata,omitempty"`
+	Battery     *api.BatteryModuleData `json:"battery,omitempty"`
+
+	// Fetched holds the time each endpoint was fetched successfully
+	Fetched map[string]time.Time `json:"fetched"`
+	// Errors holds the error message of each failed endpoint
+	Errors map[string]string `json:"errors"`
+}
+
+// OK reports whether the status could be fetched, i.e. the battery was
+// reachable.
+func (s *Snapshot) OK() bool {
+	return s.Status != nil
+}
+
+// Poller fetches a snapshot every interval.
+type Poller struct {
+	api      *api.Sonnenbatterie
+	interval time.Duration
+	timeout  time.Duration
+	polled   map[string]bool
+
+	mu          sync.Mutex
+	last        *Snapshot
+	subscribers []func(*Snapshot)
+}
+
+// New creates a poller querying the endpoints. The status is always queried,
+// it tells whether the battery is reachable. Endpoints other than status are
+// only queried if the client has a token.
+func New(a *api.Sonnenbatterie, interval, timeout time.Duration, endpoints []string) *Poller {
+	polled := map[string]bool{EndpointStatus: true}
+	for _, endpoint := range endpoints {
+		polled[endpoint] = true
+	}
+	return &Poller{
+		api:      a,
+		interval: interval,
+		timeout:  timeout,
+		polled:   polled,
+	}
+}
+
+// Subscribe registers fn to be called with every snapshot. fn is called from
+// the poll loop and must not block; slow consumers have to hand the snapshot
+// off to their own goroutine.
+func (p *Poller) Subscribe(fn func(*Snapshot)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subscribers = append(p.subscribers, fn)
+}
+
+// Channel subscribes a channel buffering size snapshots for consumers doing
+// I/O. While the channel is full snapshots are dropped, calling dropped, so a
+// slow consumer cannot block the poll loop.
+func (p *Poller) Channel(size int, dropped func()) <-chan *Snapshot {
+	ch := make(chan *Snapshot, size)
+	p.Subscribe(func(s *Snapshot) {
+		select {
+		case ch <- s:
+		default:
+			dropped()
+		}
+	})
+	return ch
+}
+
+// Last returns the most recent snapshot, nil before the first poll.
+func (p *Poller) Last() *Snapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// Run polls until ctx is done, starting immediately.
+func (p *Poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.Poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll fetches one snapshot and hands it to all subscribers.
+func (p *Poller) Poll(ctx context.Context) *Snapshot {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	s := &Snapshot{
+		Time:    time.Now(),
+		Fetched: map[string]time.Time{},
+		Errors:  map[string]string{},
+	}
+	fetch := func(endpoint string, get func() error) {
+		if !p.polled[endpoint] || (endpoint != EndpointStatus && !p.api.HasToken()) {
+			return
+		}
+		err := get()
+		switch {
+		case errors.Is(err, api.ErrUnsupported):
+			// not offered by the battery's API version, as if not polled
+			return
+		case err != nil:
+			s.Errors[endpoint] = err.Error()
+			return
+		}
+		s.Fetched[endpoint] = time.Now()
+	}
+
+	var err error
+	fetch(EndpointStatus, func() error {
+		s.Status, err = p.api.GetStatus(ctx)
+		return err
+	})
+	fetch(EndpointPowerMeter, func() error {
+		s.Production, s.Consumption, err = p.api.GetPowerMeter(ctx)
+		return err
+	})
+	fetch(EndpointLatestData, func() error {
+		s.LatestData, err = p.api.GetLatestData(ctx)
+		return err
+	})
+	fetch(EndpointBattery, func() error {
+		s.Battery, err = p.api.GetBatteryModuleData(ctx)
+		return err
+	})
+
+	p.mu.Lock()
+	p.last = s
+	subscribers := p.subscribers
+	p.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(s)
+	}
+	return s
+}
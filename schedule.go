@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+// scheduleInterval is the interval the scheduler checks the windows and the
+// battery's operating mode in.
+const scheduleInterval = 30 * time.Second
+
+// Actions of schedule windows.
+const (
+	actionCharge    = "charge"
+	actionDischarge = "discharge"
+	// hold keeps the charge by setting a setpoint of zero
+	actionHold = "hold"
+)
+
+// scheduleWindow is a daily time window in which the battery is charged,
+// discharged or held in manual mode, e.g. "charge 3kW 02:00-05:00 soc<60".
+type scheduleWindow struct {
+	spec   string
+	action string
+	watts  int
+	// start and end in minutes since midnight, end before start wraps
+	// around midnight
+	start, end int
+	// days the window starts on, indexed by time.Weekday
+	days [7]bool
+	// optional condition on the usable state of charge, op is '<' or '>'
+	socOp    byte
+	socLimit float64
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseScheduleWindow parses "<action> [<power>] <HH:MM>-<HH:MM> [<days>]
+// [soc<N|soc>N]". The power is required for charge and discharge, e.g. 3kW
+// or 2500W, and limited to maxChargeW and maxDischargeW like setpoints of the
+// control API; days are a list like mon-fri or sat,sun and default to every
+// day.
+func parseScheduleWindow(spec string, maxChargeW, maxDischargeW int) (*scheduleWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid schedule window %q: expected <action> [<power>] <HH:MM>-<HH:MM>", spec)
+	}
+	w := &scheduleWindow{spec: strings.Join(fields, " "), action: fields[0], days: [7]bool{true, true, true, true, true, true, true}}
+	fields = fields[1:]
+	switch w.action {
+	case actionCharge, actionDischarge:
+		watts, err := parsePower(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule window %q: %w", spec, err)
+		}
+		limit := maxChargeW
+		if w.action == actionDischarge {
+			limit = maxDischargeW
+		}
+		if watts > limit {
+			return nil, fmt.Errorf("invalid schedule window %q: power exceeds the maximum of %d W", spec, limit)
+		}
+		w.watts, fields = watts, fields[1:]
+	case actionHold:
+	default:
+		return nil, fmt.Errorf("invalid schedule window %q: unknown action %q", spec, w.action)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid schedule window %q: missing time range", spec)
+	}
+	from, to, ok := strings.Cut(fields[0], "-")
+	var err error
+	if w.start, err = parseClock(from); ok && err == nil {
+		w.end, err = parseClock(to)
+	}
+	if !ok || err != nil || w.start == w.end {
+		return nil, fmt.Errorf("invalid schedule window %q: invalid time range %q", spec, fields[0])
+	}
+
+	for _, f := range fields[1:] {
+		if limit, ok := strings.CutPrefix(strings.ToLower(f), "soc"); ok && len(limit) > 1 {
+			w.socOp = limit[0]
+			w.socLimit, err = strconv.ParseFloat(strings.TrimSuffix(limit[1:], "%"), 64)
+			if (w.socOp != '<' && w.socOp != '>') || err != nil {
+				return nil, fmt.Errorf("invalid schedule window %q: invalid condition %q", spec, f)
+			}
+			continue
+		}
+		if w.days, err = parseDays(f); err != nil {
+			return nil, fmt.Errorf("invalid schedule window %q: %w", spec, err)
+		}
+	}
+	return w, nil
+}
+
+func parsePower(v string) (int, error) {
+	lower := strings.ToLower(v)
+	scale := 1.0
+	if n, ok := strings.CutSuffix(lower, "kw"); ok {
+		lower, scale = n, 1000
+	} else if n, ok := strings.CutSuffix(lower, "w"); ok {
+		lower = n
+	}
+	watts, err := strconv.ParseFloat(lower, 64)
+	// fractions of a watt are truncated, e.g. 0.0001kW would do nothing
+	if err != nil || int(watts*scale) <= 0 {
+		return 0, fmt.Errorf("invalid power %q", v)
+	}
+	return int(watts * scale), nil
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseDays(v string) ([7]bool, error) {
+	var days [7]bool
+	index := func(day string) (int, error) {
+		for i, d := range weekdays {
+			if d == day {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid day %q", day)
+	}
+	for _, part := range strings.Split(strings.ToLower(v), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := index(from)
+		if err != nil {
+			return days, err
+		}
+		last := first
+		if isRange {
+			if last, err = index(to); err != nil {
+				return days, err
+			}
+		}
+		for i := first; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// occurrence returns the start of the window's occurrence that contains t.
+func (w *scheduleWindow) occurrence(t time.Time) (time.Time, bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	minute := t.Hour()*60 + t.Minute()
+	if w.start > w.end && minute < w.end {
+		// started yesterday, before midnight
+		midnight = midnight.AddDate(0, 0, -1)
+	} else if minute < w.start || (w.start < w.end && minute >= w.end) {
+		return time.Time{}, false
+	}
+	if !w.days[midnight.Weekday()] {
+		return time.Time{}, false
+	}
+	return midnight.Add(time.Duration(w.start) * time.Minute), true
+}
+
+// condition reports whether the state of charge allows the window.
+func (w *scheduleWindow) condition(soc float64) bool {
+	switch w.socOp {
+	case '<':
+		return soc < w.socLimit
+	case '>':
+		return soc > w.socLimit
+	}
+	return true
+}
+
+// setpoint is the battery power of the window in watts, positive values
+// discharge, as solar_battery_pac_total.
+func (w *scheduleWindow) setpoint() int {
+	switch w.action {
+	case actionCharge:
+		return -w.watts
+	case actionDischarge:
+		return w.watts
+	}
+	return 0
+}
+
+// scheduleState is the state of the scheduler exported as metrics.
+type scheduleState struct {
+	windows []*scheduleWindow
+	// index of the window in effect, -1 for none
+	active int
+	// the battery is in manual mode on behalf of the scheduler
+	manual bool
+	errors int
+}
+
+var scheduleMetrics = metricTable[*scheduleState]{
+	{"solar_battery_schedule_window_active", "Whether the schedule window is in effect", "", gauge, []string{"window"}, func(s *scheduleState) []sample {
+		samples := make([]sample, len(s.windows))
+		for i, w := range s.windows {
+			samples[i] = sample{boolValue(i == s.active), []string{w.spec}}
+		}
+		return samples
+	}},
+	{"solar_battery_schedule_setpoint_watts", "Battery power requested by the schedule window in effect, greater zero is discharging", "watts", gauge, nil, func(s *scheduleState) []sample {
+		if s.active < 0 {
+			return nil
+		}
+		return one(float64(s.windows[s.active].setpoint()))
+	}},
+	{"solar_battery_schedule_manual_mode", "Whether the scheduler switched the battery to manual mode", "", gauge, nil, func(s *scheduleState) []sample { return one(boolValue(s.manual)) }},
+	{"solar_battery_schedule_errors_total", "Failed attempts to apply or verify a schedule window", "", counter, nil, func(s *scheduleState) []sample { return one(float64(s.errors)) }},
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// scheduleBattery are the calls the scheduler makes.
+type scheduleBattery interface {
+	GetStatus(ctx context.Context) (*api.Status, error)
+	SetOperatingMode(ctx context.Context, mode string) error
+	Charge(ctx context.Context, watts int) error
+	Discharge(ctx context.Context, watts int) error
+}
+
+// scheduler applies the first window containing the current time whose
+// condition holds, and returns the battery to self consumption when no
+// window does. A window stopped by its condition is not resumed before its
+// next occurrence, so it does not toggle around the limit. Outside of
+// windows the operating mode is left alone, so manual control through the
+// control API is not overridden, unless the scheduler switched it to manual
+// mode before a restart.
+type scheduler struct {
+	battery  scheduleBattery
+	location *time.Location
+	// stopped holds the occurrence start of windows stopped by their
+	// condition, only accessed by step
+	stopped map[int]time.Time
+
+	mu    sync.Mutex
+	state scheduleState
+}
+
+func newScheduler(battery scheduleBattery, windows []*scheduleWindow, location *time.Location) *scheduler {
+	return &scheduler{
+		battery:  battery,
+		location: location,
+		stopped:  map[int]time.Time{},
+		state:    scheduleState{windows: windows, active: -1},
+	}
+}
+
+// run checks the schedule every scheduleInterval until ctx is done and
+// then returns the battery to self consumption.
+func (s *scheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		s.step(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			restoreCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			s.restore(restoreCtx)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// step reads the status, selects the window in effect at now and applies it
+// if it changed or the operating mode was changed by someone else.
+func (s *scheduler) step(ctx context.Context, now time.Time) {
+	status, err := s.battery.GetStatus(ctx)
+	if err != nil {
+		s.fail(err, "failed to read battery status for the schedule")
+		return
+	}
+	want := s.selectWindow(now.In(s.location), float64(status.Usoc))
+
+	s.mu.Lock()
+	active, manual := s.state.active, s.state.manual
+	s.mu.Unlock()
+	switch {
+	case want < 0 && !manual:
+		return
+	case want >= 0 && want == active && status.OperatingMode == api.ModeManual:
+		return
+	case want < 0:
+		s.restore(ctx)
+		return
+	}
+
+	w := s.state.windows[want]
+	s.setState(active, true)
+	if err := s.apply(ctx, w); err != nil {
+		s.fail(err, "failed to apply schedule window")
+		return
+	}
+	if err := s.verify(ctx, api.ModeManual); err != nil {
+		s.fail(err, "failed to verify schedule window")
+		return
+	}
+	s.setState(want, true)
+	log.Info().Str("window", w.spec).Msg("schedule window started")
+}
+
+// selectWindow returns the index of the window in effect, -1 for none.
+func (s *scheduler) selectWindow(now time.Time, soc float64) int {
+	for i, w := range s.state.windows {
+		start, ok := w.occurrence(now)
+		if !ok || s.stopped[i].Equal(start) {
+			continue
+		}
+		if !w.condition(soc) {
+			if i == s.state.active {
+				s.stopped[i] = start
+			}
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+func (s *scheduler) apply(ctx context.Context, w *scheduleWindow) error {
+	if err := s.battery.SetOperatingMode(ctx, api.ModeManual); err != nil {
+		return err
+	}
+	if w.action == actionDischarge {
+		return s.battery.Discharge(ctx, w.watts)
+	}
+	return s.battery.Charge(ctx, w.watts)
+}
+
+// verify reads the status back and checks the operating mode. The battery
+// power is not compared with the setpoint: the battery ramps up over several
+// seconds and limits it near a full or empty charge, so only the mode tells
+// whether the window was applied.
+func (s *scheduler) verify(ctx context.Context, mode string) error {
+	status, err := s.battery.GetStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if string(status.OperatingMode) != mode {
+		return fmt.Errorf("operating mode is %s instead of %s", status.OperatingMode, mode)
+	}
+	return nil
+}
+
+// restore returns the battery to self consumption if the scheduler switched
+// it to manual mode.
+func (s *scheduler) restore(ctx context.Context) {
+	s.mu.Lock()
+	active, manual := s.state.active, s.state.manual
+	s.mu.Unlock()
+	if !manual {
+		return
+	}
+	if err := s.battery.SetOperatingMode(ctx, api.ModeSelfConsumption); err != nil {
+		s.fail(err, "failed to restore self consumption")
+		return
+	}
+	if err := s.verify(ctx, api.ModeSelfConsumption); err != nil {
+		s.fail(err, "failed to verify self consumption")
+		return
+	}
+	s.setState(-1, false)
+	if active >= 0 {
+		log.Info().Str("window", s.state.windows[active].spec).Msg("schedule window ended")
+	}
+}
+
+// marshalState saves whether the battery is in manual mode on behalf of the
+// scheduler, so a restart outside of windows returns it to self consumption.
+func (s *scheduler) marshalState() (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(struct {
+		Manual bool `json:"manual"`
+	}{s.state.manual})
+}
+
+func (s *scheduler) restoreState(data json.RawMessage) error {
+	var saved struct {
+		Manual bool `json:"manual"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	s.setState(-1, saved.Manual)
+	return nil
+}
+
+func (s *scheduler) setState(active int, manual bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.active, s.state.manual = active, manual
+}
+
+func (s *scheduler) fail(err error, msg string) {
+	log.Error().Err(err).Msg(msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.errors++
+}
+
+// Describe implements Collector.
+func (s *scheduler) Describe(ch chan<- *prometheus.Desc) {
+	scheduleMetrics.describe(ch)
+}
+
+// Collect implements Collector.
+func (s *scheduler) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+	scheduleMetrics.collect(ch, &state)
+}
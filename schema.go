@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+// schemaTracker keeps the latest schema report per endpoint, logs the field
+// names whenever a report changes and exports the number of unknown and
+// missing fields.
+type schemaTracker struct {
+	mu      sync.Mutex
+	reports map[string]api.SchemaReport
+}
+
+// schemaReports are the latest schema reports by endpoint.
+type schemaReports = map[string]api.SchemaReport
+
+var schemaMetrics = metricTable[schemaReports]{
+	{"solar_battery_api_schema_unknown_fields", "Number of fields sent by the battery API that the exporter does not know", "", gauge, []string{"endpoint"}, func(r schemaReports) []sample {
+		return perEndpoint(r, func(r api.SchemaReport) int { return len(r.Unknown) })
+	}},
+	{"solar_battery_api_schema_missing_fields", "Number of fields expected by the exporter that the battery API did not send", "", gauge, []string{"endpoint"}, func(r schemaReports) []sample {
+		return perEndpoint(r, func(r api.SchemaReport) int { return len(r.Missing) })
+	}},
+}
+
+func perEndpoint(reports schemaReports, count func(api.SchemaReport) int) []sample {
+	samples := make([]sample, 0, len(reports))
+	for endpoint, r := range reports {
+		samples = append(samples, sample{float64(count(r)), []string{endpoint}})
+	}
+	return samples
+}
+
+func newSchemaTracker() *schemaTracker {
+	return &schemaTracker{reports: map[string]api.SchemaReport{}}
+}
+
+// report is used as api.Sonnenbatterie.SchemaCheck.
+func (t *schemaTracker) report(r api.SchemaReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if prev, ok := t.reports[r.Endpoint]; ok && prev.Equal(r) {
+		return
+	}
+	t.reports[r.Endpoint] = r
+
+	if len(r.Unknown) == 0 && len(r.Missing) == 0 {
+		log.Info().Str("endpoint", r.Endpoint).Msg("api schema matches")
+		return
+	}
+	log.Warn().
+		Str("endpoint", r.Endpoint).
+		Strs("unknown", r.Unknown).
+		Strs("missing", r.Missing).
+		Msg("api schema differs from expected fields")
+}
+
+// Describe implements Collector.
+func (t *schemaTracker) Describe(ch chan<- *prometheus.Desc) {
+	schemaMetrics.describe(ch)
+}
+
+// Collect implements Collector.
+func (t *schemaTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	schemaMetrics.collect(ch, t.reports)
+}
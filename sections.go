@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// collectorSections are the parts of the battery API the collector can
+// query. Each is toggled with --collector.<name> and can be selected per
+// scrape with the collect[] URL parameter.
+var collectorSections = []struct {
+	name    string
+	enabled bool
+	help    string
+}{
+	{"status", true, "Collect the status endpoint."},
+	{"powermeter", true, "Collect the power meters. Requires a token."},
+	{"latestdata", true, "Collect the latest data endpoint. Requires a token."},
+	{"battery", true, "Collect battery module data. Requires a token."},
+	{"inverter", false, "Collect inverter temperatures, voltages and I/O states. Requires a token."},
+}
+
+func defaultSections() map[string]bool {
+	enabled := make(map[string]bool, len(collectorSections))
+	for _, s := range collectorSections {
+		enabled[s.name] = s.enabled
+	}
+	return enabled
+}
+
+// filter returns a copy of the collector that only collects the named
+// sections. Unknown and disabled sections are an error.
+func (c *collector) filter(names []string) (*collector, error) {
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		on, ok := c.enabled[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		if !on {
+			return nil, fmt.Errorf("disabled collector %q", name)
+		}
+		enabled[name] = true
+	}
+	filtered := *c
+	filtered.enabled = enabled
+	return &filtered, nil
+}
+
+// metricsHandler serves the exporter's own metrics together with the battery
+// collector, restricted to the sections requested with collect[].
+type metricsHandler struct {
+	coll     *collector
+	exporter prometheus.Gatherer
+	opts     promhttp.HandlerOpts
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	coll := h.coll
+	if names := r.URL.Query()["collect[]"]; len(names) > 0 {
+		var err error
+		if coll, err = h.coll.filter(names); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(coll); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	promhttp.HandlerFor(prometheus.Gatherers{h.exporter, reg}, h.opts).ServeHTTP(w, r)
+}
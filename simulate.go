@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/simulator"
+)
+
+// runSimulate serves a simulated battery on the v2 API. It is invoked as
+// `sonnenbatterie-exporter simulate [flags]`.
+func runSimulate(args []string) error {
+	var (
+		addr  string
+		token string
+		speed float64
+		start string
+		cfg   = simulator.DefaultConfig()
+	)
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	fs.StringVar(&addr, "listen-address", ":8080", "The address to serve the simulated battery API on.")
+	fs.StringVar(&token, "token", "", "Token required for all endpoints except status. Empty disables the check.")
+	fs.Float64Var(&speed, "speed", 1, "Factor by which simulated time runs faster than the wall clock.")
+	fs.StringVar(&start, "start", "", "Simulated start time in RFC3339 format. Defaults to now.")
+	fs.Float64Var(&cfg.CapacityWh, "capacity-wh", cfg.CapacityWh, "Usable battery capacity in watt hours.")
+	fs.Float64Var(&cfg.MaxChargeW, "max-charge-w", cfg.MaxChargeW, "Maximum charge power in watts.")
+	fs.Float64Var(&cfg.MaxDischargeW, "max-discharge-w", cfg.MaxDischargeW, "Maximum discharge power in watts.")
+	fs.Float64Var(&cfg.PVPeakW, "pv-peak-w", cfg.PVPeakW, "PV production at solar noon in watts.")
+	fs.Float64Var(&cfg.BaseLoadW, "base-load-w", cfg.BaseLoadW, "Household base load in watts.")
+	fs.Float64Var(&cfg.PeakLoadW, "peak-load-w", cfg.PeakLoadW, "Additional household load at the evening peak in watts.")
+	fs.Float64Var(&cfg.InitialSoC, "initial-soc", cfg.InitialSoC, "State of charge in percent at simulation start.")
+	fs.IntVar(&cfg.BackupBuffer, "backup-buffer", cfg.BackupBuffer, "Backup buffer in percent.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	startTime := time.Now()
+	if start != "" {
+		var err error
+		if startTime, err = time.Parse(time.RFC3339, start); err != nil {
+			return err
+		}
+	}
+
+	battery := simulator.New(cfg, simulator.ScaledClock(startTime, speed))
+
+	c := alice.New(hlog.NewHandler(log), hlog.AccessHandler(accessLog))
+	log.Info().Str("addr", addr).Float64("speed", speed).Msg("serving simulated sonnenbatterie")
+	return http.ListenAndServe(addr, c.Then(battery.Handler(token)))
+}
@@ -0,0 +1,258 @@
+package simulator
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+// Status returns the simulated /status document.
+func (b *Battery) Status() api.Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+
+	soc := b.energyWh / b.cfg.CapacityWh * 100
+	// with a backup buffer of 100% nothing is usable
+	var usable float64
+	if b.backupBuffer < 100 {
+		usable = (b.energyWh - b.cfg.CapacityWh*float64(b.backupBuffer)/100) /
+			(b.cfg.CapacityWh * (1 - float64(b.backupBuffer)/100)) * 100
+	}
+
+	return api.Status{
+		ApparentOutput:            int(math.Abs(b.batteryW)),
+		BackupBuffer:              api.FlexString(strconv.Itoa(b.backupBuffer)),
+		BatteryCharging:           b.batteryW < 0,
+		BatteryDischarging:        b.batteryW > 0,
+		ConsumptionAvg:            int(b.consumptionW),
+		ConsumptionW:              int(b.consumptionW),
+		Fac:                       50,
+		FlowConsumptionBattery:    b.batteryW > 0,
+		FlowConsumptionGrid:       b.gridW < 0,
+		FlowConsumptionProduction: b.productionW > 0,
+		FlowGridBattery:           b.batteryW < 0 && b.gridW < 0,
+		FlowProductionBattery:     b.batteryW < 0 && b.productionW > 0,
+		FlowProductionGrid:        b.gridW > 0,
+		GridFeedInW:               math.Round(b.gridW),
+		IsSystemInstalled:         1,
+		OperatingMode:             api.FlexString(b.mode),
+		PacTotalW:                 int(b.batteryW),
+		ProductionW:               int(b.productionW),
+		Rsoc:                      api.FlexFloat(math.Round(soc)),
+		RemainingCapacityWh:       int(b.energyWh),
+		Sac1:                      int(math.Abs(b.batteryW) / 3),
+		Sac2:                      int(math.Abs(b.batteryW) / 3),
+		Sac3:                      int(math.Abs(b.batteryW) / 3),
+		SystemStatus:              "OnGrid",
+		Timestamp:                 b.last.Format(api.TimestampLayout),
+		Usoc:                      api.FlexFloat(math.Round(math.Max(0, usable))),
+		Uac:                       230,
+		Ubat:                      52,
+	}
+}
+
+// PowerMeters returns the simulated production and consumption meters.
+func (b *Battery) PowerMeters() []api.PowerMeter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+
+	meter := func(direction string, watts, kwh float64, channel int) api.PowerMeter {
+		return api.PowerMeter{
+			AL1:         watts / 3 / 230,
+			AL2:         watts / 3 / 230,
+			AL3:         watts / 3 / 230,
+			ATotal:      watts / 230,
+			Channel:     channel,
+			Direction:   direction,
+			Error:       -1,
+			Frequency:   50,
+			KwhImported: kwh,
+			VL1N:        230,
+			VL2N:        230,
+			VL3N:        230,
+			VL1L2:       400,
+			VL2L3:       400,
+			VL3L1:       400,
+			VaTotal:     watts,
+			WL1:         watts / 3,
+			WL2:         watts / 3,
+			WL3:         watts / 3,
+			WTotal:      watts,
+		}
+	}
+	return []api.PowerMeter{
+		meter("production", b.productionW, b.producedKwh, 1),
+		meter("consumption", b.consumptionW, b.consumedKwh, 2),
+	}
+}
+
+// LatestData returns the simulated /latestdata document.
+func (b *Battery) LatestData() api.LatestData {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+
+	var latest api.LatestData
+	latest.FullChargeCapacity = int(b.cfg.CapacityWh)
+	latest.IcStatus.SecondsSinceFullCharge = int(b.last.Sub(b.lastFullCharge).Seconds())
+	return latest
+}
+
+// BatteryModuleData returns the simulated /battery document.
+func (b *Battery) BatteryModuleData() api.BatteryModuleData {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+
+	modules := float64(b.cfg.Modules)
+	voltage := 48 + 6*b.energyWh/b.cfg.CapacityWh
+	current := -b.batteryW / voltage
+	soc := math.Round(b.energyWh / b.cfg.CapacityWh * 100)
+
+	stack := make([]api.BatteryModule, b.cfg.Modules)
+	for i := range stack {
+		// later modules in the stack run slightly warmer
+		offset := float64(i) * 0.2
+		stack[i] = api.BatteryModule{
+			CycleCount:             b.cycleCount,
+			FullChargeCapacity:     b.cfg.CapacityWh / voltage / modules,
+			MaximumCellTemperature: 22 + offset + math.Abs(current)/20,
+			MaximumCellVoltage:     voltage/16 + 0.003,
+			MinimumCellTemperature: 21 + offset + math.Abs(current)/20,
+			MinimumCellVoltage:     voltage / 16,
+			ModuleCurrent:          current / modules,
+			ModuleDCVoltage:        voltage,
+			RelativeStateOfCharge:  soc,
+			RemainingCapacity:      b.energyWh / voltage / modules,
+		}
+	}
+
+	return api.BatteryModuleData{
+		CycleCount:             b.cycleCount,
+		FullChargeCapacity:     b.cfg.CapacityWh / voltage,
+		MaximumCellTemperature: 22 + math.Abs(current)/20,
+		MaximumCellVoltage:     voltage/16 + 0.003,
+		MaximumModuleCurrent:   current / modules,
+		MaximumModuleDCVoltage: voltage,
+		MinimumCellTemperature: 21 + math.Abs(current)/20,
+		MinimumCellVoltage:     voltage / 16,
+		MinimumModuleCurrent:   current / modules,
+		MinimumModuleDCVoltage: voltage,
+		RelativeStateOfCharge:  soc,
+		RemainingCapacity:      b.energyWh / voltage,
+		SystemCurrent:          current,
+		SystemVoltage:          voltage,
+		SystemDCVoltage:        voltage,
+		SystemStatus:           49,
+		Modules:                stack,
+	}
+}
+
+// Handler serves the v2 API of the simulated battery. When token is set all
+// endpoints except status require it in the Auth-Token header, like on a
+// real device.
+func (b *Battery) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v2/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, b.Status())
+	})
+
+	auth := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if token != "" && r.Header.Get("Auth-Token") != token {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+	mux.HandleFunc("GET /api/v2/powermeter", auth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, b.PowerMeters())
+	}))
+	mux.HandleFunc("GET /api/v2/latestdata", auth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, b.LatestData())
+	}))
+	mux.HandleFunc("GET /api/v2/battery", auth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, b.BatteryModuleData())
+	}))
+	mux.HandleFunc("GET /api/v2/configurations", auth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, b.configurations())
+	}))
+	mux.HandleFunc("PUT /api/v2/configurations", auth(b.putConfigurations))
+	mux.HandleFunc("POST /api/v2/setpoint/{direction}/{watts}", auth(b.postSetpoint))
+	return mux
+}
+
+func (b *Battery) configurations() map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]string{
+		"EM_OperatingMode": b.mode,
+		"EM_USOC":          strconv.Itoa(b.backupBuffer),
+	}
+}
+
+// putConfigurations accepts EM_OperatingMode and EM_USOC either as JSON
+// object or as form values.
+func (b *Battery) putConfigurations(w http.ResponseWriter, r *http.Request) {
+	values := map[string]string{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k := range r.PostForm {
+			values[k] = r.PostForm.Get(k)
+		}
+	}
+
+	if mode, ok := values["EM_OperatingMode"]; ok && !b.SetMode(mode) {
+		http.Error(w, "invalid EM_OperatingMode", http.StatusBadRequest)
+		return
+	}
+	if buffer, ok := values["EM_USOC"]; ok {
+		percent, err := strconv.Atoi(buffer)
+		if err != nil || !b.SetBackupBuffer(percent) {
+			http.Error(w, "invalid EM_USOC", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, b.configurations())
+}
+
+func (b *Battery) postSetpoint(w http.ResponseWriter, r *http.Request) {
+	watts, err := strconv.ParseFloat(r.PathValue("watts"), 64)
+	if err != nil || watts < 0 {
+		http.Error(w, "invalid setpoint", http.StatusBadRequest)
+		return
+	}
+	switch r.PathValue("direction") {
+	case "charge":
+		watts = -watts
+	case "discharge":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !b.SetSetpoint(watts) {
+		http.Error(w, "setpoints require manual operating mode", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, true)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,252 @@
+// Package simulator models a sonnenBatterie and serves its state through the
+// same v2 JSON API as a real device, so the exporter can be developed and
+// demonstrated without hardware.
+package simulator
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+// Operating modes as reported in Status.OperatingMode.
+const (
+	ModeManual          = api.ModeManual
+	ModeSelfConsumption = api.ModeSelfConsumption
+)
+
+// Config describes the simulated installation.
+type Config struct {
+	// Usable battery capacity in watt hours
+	CapacityWh float64
+	// Inverter limits for charging and discharging in watts
+	MaxChargeW    float64
+	MaxDischargeW float64
+	// PV peak production at solar noon in watts
+	PVPeakW float64
+	// Hours of sunrise and sunset in local time
+	Sunrise float64
+	Sunset  float64
+	// Household base load in watts, morning and evening peaks come on top
+	BaseLoadW float64
+	PeakLoadW float64
+	// Initial state of charge in percent
+	InitialSoC float64
+	// Backup buffer in percent that self consumption does not discharge below
+	BackupBuffer int
+	// Cycle count of the battery at simulation start
+	CycleCount float64
+	// Number of battery modules
+	Modules int
+}
+
+// DefaultConfig returns a 10 kWh battery with a 6 kWp PV array.
+func DefaultConfig() Config {
+	return Config{
+		CapacityWh:    10000,
+		MaxChargeW:    3300,
+		MaxDischargeW: 3300,
+		PVPeakW:       6000,
+		Sunrise:       6,
+		Sunset:        20,
+		BaseLoadW:     300,
+		PeakLoadW:     1800,
+		InitialSoC:    50,
+		BackupBuffer:  10,
+		CycleCount:    120,
+		Modules:       4,
+	}
+}
+
+// Battery is the simulated device. It advances lazily whenever its state is
+// read, integrating the power flows since the previous step.
+type Battery struct {
+	cfg   Config
+	clock func() time.Time
+
+	mu   sync.Mutex
+	last time.Time
+
+	energyWh       float64
+	mode           string
+	setpointW      float64
+	backupBuffer   int
+	cycleCount     float64
+	throughputWh   float64
+	lastFullCharge time.Time
+
+	productionW  float64
+	consumptionW float64
+	batteryW     float64 // positive is discharging
+	gridW        float64 // positive is feed in
+
+	producedKwh float64
+	consumedKwh float64
+}
+
+// New creates a battery simulated on the given clock. A nil clock uses
+// time.Now.
+func New(cfg Config, clock func() time.Time) *Battery {
+	if clock == nil {
+		clock = time.Now
+	}
+	now := clock()
+	b := &Battery{
+		cfg:            cfg,
+		clock:          clock,
+		last:           now,
+		energyWh:       cfg.CapacityWh * cfg.InitialSoC / 100,
+		mode:           ModeSelfConsumption,
+		backupBuffer:   cfg.BackupBuffer,
+		cycleCount:     cfg.CycleCount,
+		lastFullCharge: now.Add(-24 * time.Hour),
+	}
+	b.updateFlows(now)
+	return b
+}
+
+// ScaledClock returns a clock that starts at start and runs speed times
+// faster than the wall clock.
+func ScaledClock(start time.Time, speed float64) func() time.Time {
+	origin := time.Now()
+	return func() time.Time {
+		elapsed := time.Since(origin)
+		return start.Add(time.Duration(float64(elapsed) * speed))
+	}
+}
+
+// SetMode switches between ModeManual and ModeSelfConsumption. Leaving manual
+// mode clears the setpoint.
+func (b *Battery) SetMode(mode string) bool {
+	if mode != ModeManual && mode != ModeSelfConsumption {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+	b.mode = mode
+	if mode != ModeManual {
+		b.setpointW = 0
+	}
+	b.updateFlows(b.last)
+	return true
+}
+
+// SetSetpoint sets the battery power in manual mode, positive values
+// discharge and negative values charge. It fails outside manual mode.
+func (b *Battery) SetSetpoint(watts float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mode != ModeManual {
+		return false
+	}
+	b.advance()
+	b.setpointW = watts
+	b.updateFlows(b.last)
+	return true
+}
+
+// SetBackupBuffer sets the reserve in percent.
+func (b *Battery) SetBackupBuffer(percent int) bool {
+	if percent < 0 || percent > 100 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+	b.backupBuffer = percent
+	b.updateFlows(b.last)
+	return true
+}
+
+// advance integrates the flows of the previous step up to now. Callers must
+// hold the lock.
+func (b *Battery) advance() {
+	now := b.clock()
+	// integrate in steps of at most a minute so fast clocks still follow
+	// the production and load curves
+	for b.last.Before(now) {
+		step := now.Sub(b.last)
+		if step > time.Minute {
+			step = time.Minute
+		}
+		hours := step.Hours()
+
+		before := b.energyWh
+		b.energyWh -= b.batteryW * hours
+		b.energyWh = math.Max(0, math.Min(b.cfg.CapacityWh, b.energyWh))
+		b.throughputWh += math.Abs(b.energyWh - before)
+		if b.throughputWh >= 2*b.cfg.CapacityWh {
+			b.cycleCount++
+			b.throughputWh -= 2 * b.cfg.CapacityWh
+		}
+
+		b.producedKwh += b.productionW * hours / 1000
+		b.consumedKwh += b.consumptionW * hours / 1000
+
+		b.last = b.last.Add(step)
+		if b.energyWh >= b.cfg.CapacityWh {
+			b.lastFullCharge = b.last
+		}
+		b.updateFlows(b.last)
+	}
+}
+
+// updateFlows derives the instantaneous power flows at t from the model.
+// Callers must hold the lock.
+func (b *Battery) updateFlows(t time.Time) {
+	b.productionW = b.pv(t)
+	b.consumptionW = b.load(t)
+
+	var want float64
+	if b.mode == ModeManual {
+		want = b.setpointW
+	} else {
+		want = b.consumptionW - b.productionW
+	}
+
+	if want > 0 {
+		reserve := b.cfg.CapacityWh * float64(b.backupBuffer) / 100
+		if b.mode == ModeManual {
+			reserve = 0
+		}
+		if b.energyWh <= reserve {
+			want = 0
+		}
+		want = math.Min(want, b.cfg.MaxDischargeW)
+	} else {
+		if b.energyWh >= b.cfg.CapacityWh {
+			want = 0
+		}
+		want = math.Max(want, -b.cfg.MaxChargeW)
+	}
+
+	b.batteryW = want
+	b.gridW = b.productionW + b.batteryW - b.consumptionW
+}
+
+// pv returns a half sine production curve between sunrise and sunset.
+func (b *Battery) pv(t time.Time) float64 {
+	h := hourOfDay(t)
+	if h <= b.cfg.Sunrise || h >= b.cfg.Sunset {
+		return 0
+	}
+	x := (h - b.cfg.Sunrise) / (b.cfg.Sunset - b.cfg.Sunrise)
+	return b.cfg.PVPeakW * math.Sin(math.Pi*x)
+}
+
+// load returns the base load with gaussian peaks in the morning and evening.
+func (b *Battery) load(t time.Time) float64 {
+	h := hourOfDay(t)
+	peak := func(center, width float64) float64 {
+		d := (h - center) / width
+		return math.Exp(-d * d / 2)
+	}
+	return b.cfg.BaseLoadW + b.cfg.PeakLoadW*(0.5*peak(7.5, 1)+peak(19, 1.5))
+}
+
+func hourOfDay(t time.Time) float64 {
+	return float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+}
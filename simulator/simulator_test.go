@@ -0,0 +1,130 @@
+package simulator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time      { return c.t }
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+func newFakeClock(hour int) *fakeClock {
+	return &fakeClock{t: time.Date(2024, 6, 21, hour, 0, 0, 0, time.UTC)}
+}
+
+func TestSelfConsumptionChargesAtNoon(t *testing.T) {
+	clock := newFakeClock(12)
+	b := New(DefaultConfig(), clock.now)
+
+	before := b.Status()
+	if before.ProductionW <= before.ConsumptionW {
+		t.Fatalf("expected PV surplus at noon, got production=%d consumption=%d", before.ProductionW, before.ConsumptionW)
+	}
+	if before.PacTotalW != -3300 {
+		t.Errorf("expected charging at the power limit, got %d", before.PacTotalW)
+	}
+
+	clock.add(time.Hour)
+	after := b.Status()
+	if got := after.RemainingCapacityWh - before.RemainingCapacityWh; got < 3200 || got > 3300 {
+		t.Errorf("expected about 3300 Wh charged within an hour, got %d", got)
+	}
+}
+
+func TestSelfConsumptionStopsAtBackupBuffer(t *testing.T) {
+	clock := newFakeClock(22)
+	cfg := DefaultConfig()
+	cfg.InitialSoC = 12
+	b := New(cfg, clock.now)
+
+	clock.add(3 * time.Hour)
+	status := b.Status()
+	if int(status.Rsoc) != cfg.BackupBuffer {
+		t.Errorf("expected discharge to stop at backup buffer %d%%, got %v%%", cfg.BackupBuffer, status.Rsoc)
+	}
+	if status.PacTotalW != 0 {
+		t.Errorf("expected no battery power at backup buffer, got %d", status.PacTotalW)
+	}
+	if status.GridFeedInW >= 0 {
+		t.Errorf("expected grid import, got %v", status.GridFeedInW)
+	}
+}
+
+func TestWriteEndpoints(t *testing.T) {
+	clock := newFakeClock(22)
+	b := New(DefaultConfig(), clock.now)
+	srv := httptest.NewServer(b.Handler("secret"))
+	defer srv.Close()
+
+	do := func(method, path, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Auth-Token", "secret")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := do("POST", "/api/v2/setpoint/charge/2000", ""); code != http.StatusForbidden {
+		t.Errorf("expected setpoint to be rejected in self consumption mode, got %d", code)
+	}
+	if code := do("PUT", "/api/v2/configurations", `{"EM_OperatingMode":"1"}`); code != http.StatusOK {
+		t.Fatalf("unexpected status switching mode: %d", code)
+	}
+	if code := do("POST", "/api/v2/setpoint/charge/2000", ""); code != http.StatusOK {
+		t.Fatalf("unexpected status setting setpoint: %d", code)
+	}
+
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := a.GetStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.OperatingMode != ModeManual || status.PacTotalW != -2000 {
+		t.Errorf("expected manual charging at 2000 W, got mode=%s pac=%d", status.OperatingMode, status.PacTotalW)
+	}
+	if _, _, err := a.GetPowerMeter(context.Background()); err != nil {
+		t.Errorf("unexpected powermeter error: %v", err)
+	}
+}
+
+func TestFullBackupBuffer(t *testing.T) {
+	clock := newFakeClock(12)
+	cfg := DefaultConfig()
+	cfg.InitialSoC = 100
+	b := New(cfg, clock.now)
+	if !b.SetBackupBuffer(100) {
+		t.Fatal("expected a backup buffer of 100% to be accepted")
+	}
+	srv := httptest.NewServer(b.Handler("secret"))
+	defer srv.Close()
+
+	a, err := api.NewSonnenbatterie(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := a.GetStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Usoc != 0 || status.Rsoc != 100 {
+		t.Errorf("expected no usable charge of a full pack, got usoc=%v rsoc=%v", status.Usoc, status.Rsoc)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateSaveInterval is how often the state file is written while running.
+const stateSaveInterval = time.Minute
+
+// stateful is a part of the exporter whose state survives restarts.
+type stateful interface {
+	marshalState() (json.RawMessage, error)
+	restoreState(json.RawMessage) error
+}
+
+// stateStore persists the registered parts in one JSON file, keyed by name.
+// Without a path nothing is loaded or saved.
+type stateStore struct {
+	path string
+
+	mu    sync.Mutex
+	saved map[string]json.RawMessage
+	parts map[string]stateful
+}
+
+// newStateStore reads the state file if it exists.
+func newStateStore(path string) (*stateStore, error) {
+	s := &stateStore{
+		path:  path,
+		saved: map[string]json.RawMessage{},
+		parts: map[string]stateful{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.saved); err != nil {
+		return nil, fmt.Errorf("error parsing state file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// register restores the part's saved state and includes it in future saves.
+func (s *stateStore) register(name string, part stateful) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if saved, ok := s.saved[name]; ok {
+		if err := part.restoreState(saved); err != nil {
+			return fmt.Errorf("error restoring %s state: %w", name, err)
+		}
+	}
+	s.parts[name] = part
+	return nil
+}
+
+// save atomically replaces the state file. State of parts saved by a
+// previous run but not registered in this one is kept.
+func (s *stateStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, part := range s.parts {
+		state, err := part.marshalState()
+		if err != nil {
+			return fmt.Errorf("error saving %s state: %w", name, err)
+		}
+		s.saved[name] = state
+	}
+	data, err := json.MarshalIndent(s.saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// run saves the state periodically until ctx is done. The last save is left
+// to the caller, once the parts have stopped changing.
+func (s *stateStore) run(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Error().Err(err).Msg("failed to save state")
+			}
+		}
+	}
+}
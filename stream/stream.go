@@ -0,0 +1,234 @@
+// Package stream pushes the polled snapshots to HTTP clients as Server-Sent
+// Events.
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+)
+
+const (
+	// clientBuffer is the number of snapshots queued per client. While it is
+	// full, the oldest queued snapshot is dropped for the newest.
+	clientBuffer = 8
+	// keepAlive is the interval of comments sent to keep idle connections
+	// open through proxies
+	keepAlive = 30 * time.Second
+	// writeTimeout is the default time an event may take to be written
+	writeTimeout = 10 * time.Second
+)
+
+// document is a snapshot decoded into generic JSON values, so clients can
+// select fields.
+type document = map[string]any
+
+// Hub broadcasts the snapshots of a poller to the connected clients.
+type Hub struct {
+	// WriteTimeout bounds the time writing an event to a client may take.
+	// Stalled clients are disconnected once it passes.
+	WriteTimeout time.Duration
+
+	poller  *poller.Poller
+	dropped atomic.Uint64
+
+	mu      sync.Mutex
+	clients map[chan document]struct{}
+}
+
+// NewHub subscribes to the poller.
+func NewHub(p *poller.Poller) *Hub {
+	h := &Hub{WriteTimeout: writeTimeout, poller: p, clients: map[chan document]struct{}{}}
+	p.Subscribe(h.broadcast)
+	return h
+}
+
+// Clients returns the number of connected clients.
+func (h *Hub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Dropped returns the number of snapshots dropped for slow clients.
+func (h *Hub) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+// broadcast hands the snapshot to every client without blocking the poll
+// loop. Clients that fall behind lose their oldest queued snapshot, so they
+// always catch up to the current state.
+func (h *Hub) broadcast(s *poller.Snapshot) {
+	doc, err := decode(s)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- doc:
+			continue
+		default:
+		}
+		select {
+		case <-ch:
+			h.dropped.Add(1)
+		default:
+		}
+		select {
+		case ch <- doc:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+}
+
+func (h *Hub) add() chan document {
+	ch := make(chan document, clientBuffer)
+	h.mu.Lock()
+	h.clients[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *Hub) remove(ch chan document) {
+	h.mu.Lock()
+	delete(h.clients, ch)
+	h.mu.Unlock()
+}
+
+// ServeHTTP streams a snapshot event for the last and every following poll.
+// ?fields=status.USOC,battery restricts the events to the given fields, by
+// their JSON names; the time is always included.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	fields := parseFields(r.URL.Query().Get("fields"))
+	ch := h.add()
+	defer h.remove(ch)
+
+	// every write is flushed within the write timeout, a client that stops
+	// reading is dropped instead of blocking this goroutine
+	rc := http.NewResponseController(w)
+	send := func(write func() error) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(h.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		if err := write(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := send(func() error {
+		w.WriteHeader(http.StatusOK)
+		if last := h.poller.Last(); last != nil {
+			if doc, err := decode(last); err == nil {
+				return writeEvent(w, filter(doc, fields))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case doc := <-ch:
+			err = send(func() error { return writeEvent(w, filter(doc, fields)) })
+		case <-ticker.C:
+			err = send(func() error {
+				_, err := fmt.Fprint(w, ": keep-alive\n\n")
+				return err
+			})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, doc document) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", data)
+	return err
+}
+
+func decode(s *poller.Snapshot) (document, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var doc document
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// parseFields splits a comma separated list of dotted paths, nil for all
+// fields. Deeper paths come first, so filter never writes into a document
+// shared with other clients that a shorter path copied.
+func parseFields(v string) [][]string {
+	var fields [][]string
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, strings.Split(f, "."))
+		}
+	}
+	slices.SortStableFunc(fields, func(a, b []string) int { return len(b) - len(a) })
+	return fields
+}
+
+// filter returns the time and the selected fields of doc. Fields that do not
+// exist are left out.
+func filter(doc document, fields [][]string) document {
+	if len(fields) == 0 {
+		return doc
+	}
+	out := document{"time": doc["time"]}
+	for _, path := range fields {
+		copyPath(out, doc, path)
+	}
+	return out
+}
+
+func copyPath(dst, src document, path []string) {
+	v, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+	sub, ok := v.(document)
+	if !ok {
+		return
+	}
+	d, ok := dst[path[0]].(document)
+	if !ok {
+		d = document{}
+		dst[path[0]] = d
+	}
+	copyPath(d, sub, path[1:])
+}
@@ -0,0 +1,106 @@
+package stream_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/api"
+	"github.com/joconcepts/sonnenbatterie-exporter/api/apitest"
+	"github.com/joconcepts/sonnenbatterie-exporter/poller"
+	"github.com/joconcepts/sonnenbatterie-exporter/stream"
+)
+
+func TestStream(t *testing.T) {
+	battery := apitest.NewServer()
+	t.Cleanup(battery.Close)
+	a, err := api.NewSonnenbatterie(battery.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := poller.New(a, time.Minute, time.Second, nil)
+	srv := httptest.NewServer(stream.NewHub(p))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connect := func(query string) *bufio.Scanner {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("unexpected content type %s", ct)
+		}
+		return bufio.NewScanner(resp.Body)
+	}
+	next := func(scanner *bufio.Scanner) string {
+		t.Helper()
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				return data
+			}
+		}
+		t.Fatalf("no event received: %v", scanner.Err())
+		return ""
+	}
+
+	all := connect("")
+	filtered := connect("?fields=status.RSOC,status.USOC,battery")
+	p.Poll(ctx)
+
+	var s poller.Snapshot
+	if err := json.Unmarshal([]byte(next(all)), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Status == nil || s.Status.Rsoc != 7 || s.Fetched[poller.EndpointStatus].IsZero() {
+		t.Errorf("unexpected snapshot %+v", s)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(next(filtered)), &doc); err != nil {
+		t.Fatal(err)
+	}
+	// battery is not polled without a token
+	status, _ := doc["status"].(map[string]any)
+	if len(doc) != 2 || doc["time"] == nil || len(status) != 2 || status["RSOC"] != 7.0 {
+		t.Errorf("unexpected filtered snapshot %v", doc)
+	}
+}
+
+func TestStreamWriteTimeout(t *testing.T) {
+	battery := apitest.NewServer()
+	t.Cleanup(battery.Close)
+	a, err := api.NewSonnenbatterie(battery.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := stream.NewHub(poller.New(a, time.Minute, time.Second, nil))
+	// every write misses its deadline, as for a client that stopped reading
+	hub.WriteTimeout = time.Nanosecond
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected the stalled client to be disconnected")
+	}
+	for hub.Clients() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
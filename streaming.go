@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/joconcepts/sonnenbatterie-exporter/stream"
+)
+
+var streamMetrics = metricTable[*stream.Hub]{
+	{"solar_battery_stream_clients", "Number of clients connected to the live stream", "", gauge, nil, func(h *stream.Hub) []sample { return one(float64(h.Clients())) }},
+	{"solar_battery_stream_dropped_total", "Snapshots dropped for stream clients that fell behind", "", counter, nil, func(h *stream.Hub) []sample { return one(float64(h.Dropped())) }},
+}
+
+// streamCollector exports the state of the live stream.
+type streamCollector struct {
+	hub *stream.Hub
+}
+
+// Describe implements Collector.
+func (c streamCollector) Describe(ch chan<- *prometheus.Desc) {
+	streamMetrics.describe(ch)
+}
+
+// Collect implements Collector.
+func (c streamCollector) Collect(ch chan<- prometheus.Metric) {
+	streamMetrics.collect(ch, c.hub)
+}